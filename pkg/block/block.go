@@ -292,6 +292,27 @@ func IsBlockDir(path string) (id ulid.ULID, ok bool) {
 	return id, err == nil
 }
 
+// TenantBlockPath returns the object name of the given file within the block directory of the tenant, e.g. <tenant>/<ULID>/meta.json.
+// Empty tenant means single-tenant layout with block directories at the bucket root. Empty file means the block directory itself.
+func TenantBlockPath(tenant string, id ulid.ULID, file string) string {
+	return path.Join(tenant, id.String(), file)
+}
+
+// ParseTenantBlockPath parses the object name built by TenantBlockPath. The first path segment that is a valid ULID is
+// treated as the block directory, so tenant can be nested (e.g. "org/team") and file can be nested (e.g. "chunks/000001").
+// It returns false if name does not contain a block directory.
+func ParseTenantBlockPath(name string) (tenant string, id ulid.ULID, file string, ok bool) {
+	parts := strings.Split(strings.Trim(name, objstore.DirDelim), objstore.DirDelim)
+	for i, p := range parts {
+		id, err := ulid.Parse(p)
+		if err != nil {
+			continue
+		}
+		return path.Join(parts[:i]...), id, path.Join(parts[i+1:]...), true
+	}
+	return "", ulid.ULID{}, "", false
+}
+
 // GetSegmentFiles returns list of segment files for given block. Paths are relative to the chunks directory.
 // In case of errors, nil is returned.
 func GetSegmentFiles(blockDir string) []string {
@@ -390,3 +411,50 @@ func MarkForNoCompact(ctx context.Context, logger log.Logger, bkt objstore.Bucke
 	level.Info(logger).Log("msg", "block has been marked for no compaction", "block", id)
 	return nil
 }
+
+// Totals is the storage footprint of a set of blocks.
+type Totals struct {
+	Blocks int
+	// Bytes is the sum of sizes of block files listed in meta.json. Blocks without files in meta.json are not accounted.
+	Bytes      int64
+	Series     uint64
+	Chunks     uint64
+	Samples    uint64
+	Tombstones uint64
+	// Coverage is the duration of time covered by at least one block.
+	Coverage time.Duration
+}
+
+// ComputeTotals returns the storage footprint of given blocks, e.g. the view returned by the MetadataFetcher.
+func ComputeTotals(metas map[ulid.ULID]*metadata.Meta) Totals {
+	t := Totals{Blocks: len(metas)}
+
+	ranges := make([][2]int64, 0, len(metas))
+	for _, m := range metas {
+		for _, f := range m.Thanos.Files {
+			t.Bytes += f.SizeBytes
+		}
+		t.Series += m.Stats.NumSeries
+		t.Chunks += m.Stats.NumChunks
+		t.Samples += m.Stats.NumSamples
+		t.Tombstones += m.Stats.NumTombstones
+		ranges = append(ranges, [2]int64{m.MinTime, m.MaxTime})
+	}
+
+	// Merge overlapping time ranges, so overlapping blocks are not counted twice.
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var covered, end int64
+	for i, r := range ranges {
+		if i == 0 || r[0] > end {
+			covered += r[1] - r[0]
+			end = r[1]
+			continue
+		}
+		if r[1] > end {
+			covered += r[1] - end
+			end = r[1]
+		}
+	}
+	t.Coverage = time.Duration(covered) * time.Millisecond
+	return t
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/testutil"
@@ -75,6 +76,58 @@ func TestIsBlockDir(t *testing.T) {
 	}
 }
 
+func TestTenantBlockPath(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+
+	for _, tc := range []struct {
+		tenant, file string
+		expected     string
+	}{
+		{tenant: "", file: MetaFilename, expected: id.String() + "/meta.json"},
+		{tenant: "tenant-1", file: MetaFilename, expected: "tenant-1/" + id.String() + "/meta.json"},
+		{tenant: "org/team", file: MetaFilename, expected: "org/team/" + id.String() + "/meta.json"},
+		{tenant: "tenant-1", file: "chunks/000001", expected: "tenant-1/" + id.String() + "/chunks/000001"},
+		{tenant: "tenant-1", file: "", expected: "tenant-1/" + id.String()},
+	} {
+		t.Run(tc.expected, func(t *testing.T) {
+			name := TenantBlockPath(tc.tenant, id, tc.file)
+			testutil.Equals(t, tc.expected, name)
+
+			tenant, parsedID, file, ok := ParseTenantBlockPath(name)
+			testutil.Assert(t, ok, "expected block path")
+			testutil.Equals(t, tc.tenant, tenant)
+			testutil.Equals(t, id, parsedID)
+			testutil.Equals(t, tc.file, file)
+		})
+	}
+}
+
+func TestParseTenantBlockPath(t *testing.T) {
+	id := ulid.MustNew(1, nil)
+
+	for _, tc := range []struct {
+		input        string
+		tenant, file string
+		ok           bool
+	}{
+		{input: ""},
+		{input: "tenant-1/meta.json"},
+		{input: "tenant-1/" + id.String() + "/", tenant: "tenant-1", ok: true},
+		{input: "/" + id.String() + "/meta.json", file: MetaFilename, ok: true},
+		{input: "a/b/c/" + id.String() + "/deletion-mark.json", tenant: "a/b/c", file: "deletion-mark.json", ok: true},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			tenant, parsedID, file, ok := ParseTenantBlockPath(tc.input)
+			testutil.Equals(t, tc.ok, ok)
+			testutil.Equals(t, tc.tenant, tenant)
+			testutil.Equals(t, tc.file, file)
+			if ok {
+				testutil.Equals(t, id, parsedID)
+			}
+		})
+	}
+}
+
 func TestUpload(t *testing.T) {
 	defer testutil.TolerantVerifyLeak(t)
 
@@ -536,3 +589,36 @@ func (eb errBucket) Upload(ctx context.Context, name string, r io.Reader) error
 	}
 	return nil
 }
+
+func TestComputeTotals(t *testing.T) {
+	testutil.Equals(t, Totals{}, ComputeTotals(nil))
+
+	meta := func(id int, mint, maxt int64, files ...int64) *metadata.Meta {
+		m := &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				ULID: ULID(id), MinTime: mint, MaxTime: maxt,
+				Stats: tsdb.BlockStats{NumSeries: 10, NumChunks: 100, NumSamples: 1000, NumTombstones: 1},
+			},
+		}
+		for _, size := range files {
+			m.Thanos.Files = append(m.Thanos.Files, metadata.File{SizeBytes: size})
+		}
+		return m
+	}
+
+	testutil.Equals(t, Totals{
+		Blocks:     4,
+		Bytes:      1234,
+		Series:     40,
+		Chunks:     400,
+		Samples:    4000,
+		Tombstones: 4,
+		// 0-2h and 1h-3h overlap, 4h-5h is separate, 4h-4h30m is within it.
+		Coverage: 4 * time.Hour,
+	}, ComputeTotals(map[ulid.ULID]*metadata.Meta{
+		ULID(1): meta(1, 0, 2*time.Hour.Milliseconds(), 1000, 200),
+		ULID(2): meta(2, time.Hour.Milliseconds(), 3*time.Hour.Milliseconds(), 34),
+		ULID(3): meta(3, 4*time.Hour.Milliseconds(), 5*time.Hour.Milliseconds()),
+		ULID(4): meta(4, 4*time.Hour.Milliseconds(), 4*time.Hour.Milliseconds()+30*time.Minute.Milliseconds()),
+	}))
+}
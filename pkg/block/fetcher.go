@@ -4,25 +4,37 @@
 package block
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"container/list"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unsafe"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/golang/groupcache/singleflight"
+	"github.com/jpillora/backoff"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/relabel"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb"
 	"golang.org/x/sync/errgroup"
 	"gopkg.in/yaml.v2"
@@ -33,6 +45,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/model"
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/runutil"
+	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
 const FetcherConcurrency = 32
@@ -47,6 +60,10 @@ type FetcherMetrics struct {
 
 	Synced   *extprom.TxGaugeVec
 	Modified *extprom.TxGaugeVec
+
+	PartialRatio prometheus.Gauge
+
+	DroppedEvents prometheus.Counter
 }
 
 // Submit applies new values for metrics tracked by transaction GaugeVec.
@@ -68,12 +85,25 @@ const (
 	NoMeta        = "no-meta-json"
 	LoadedMeta    = "loaded"
 	FailedMeta    = "failed"
+	// ClockSkewedMeta is label for blocks which ULID time is too far in the future, likely due to clock skew of the producer.
+	// Unless quarantined, those blocks are loaded, so this label is also counted in `loaded` label metric.
+	ClockSkewedMeta = "clock-skewed"
+	// InvalidMeta is label for blocks which meta.json is parseable, but semantically invalid. Those blocks are partial.
+	InvalidMeta = "invalid-meta-json"
 
 	// Synced label values.
 	labelExcludedMeta = "label-excluded"
+	labelMismatchMeta = "label-mismatch"
 	timeExcludedMeta  = "time-excluded"
 	tooFreshMeta      = "too-fresh"
+	tooOldMeta        = "too-old"
 	duplicateMeta     = "duplicate"
+	// Blocks produced by Thanos version outside of the compatible range. Those blocks are partial.
+	incompatibleVersionMeta = "incompatible-version"
+	// Blocks that are not loaded, because the limit of blocks was exceeded.
+	blockLimitExceededMeta = "block-limit-exceeded"
+	// Blocks that are not loaded, because the memory limit of cached metas was exceeded.
+	memoryLimitExceededMeta = "memory-limit-exceeded"
 	// Blocks that are marked for deletion can be loaded as well. This is done to make sure that we load blocks that are meant to be deleted,
 	// but don't have a replacement block yet.
 	MarkedForDeletionMeta = "marked-for-deletion"
@@ -117,10 +147,17 @@ func NewFetcherMetrics(reg prometheus.Registerer, syncedExtraLabels, modifiedExt
 			{NoMeta},
 			{LoadedMeta},
 			{tooFreshMeta},
+			{tooOldMeta},
 			{FailedMeta},
+			{ClockSkewedMeta},
+			{InvalidMeta},
 			{labelExcludedMeta},
+			{labelMismatchMeta},
 			{timeExcludedMeta},
 			{duplicateMeta},
+			{incompatibleVersionMeta},
+			{blockLimitExceededMeta},
+			{memoryLimitExceededMeta},
 			{MarkedForDeletionMeta},
 			{MarkedForNoCompactionMeta},
 		}, syncedExtraLabels...)...,
@@ -137,9 +174,30 @@ func NewFetcherMetrics(reg prometheus.Registerer, syncedExtraLabels, modifiedExt
 			{replicaRemovedMeta},
 		}, modifiedExtraLabels...)...,
 	)
+	m.PartialRatio = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "partial_ratio",
+		Help:      "Ratio of partial blocks (e.g. without or with corrupted meta.json) to all blocks discovered during the last synchronization, before applying filters",
+	})
+	m.DroppedEvents = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "dropped_events_total",
+		Help:      "Total block events not emitted, because the events channel was full",
+	})
 	return &m
 }
 
+// PartialRatio returns the ratio of partial blocks to all discovered blocks, or 0 if there are no blocks.
+// Persistently high ratio indicates a producer that keeps leaving partially uploaded blocks.
+// Discovered blocks are the ones loaded before applying filters, as used by the partial_ratio metric, so metas returned
+// by a fetcher with filters give a higher ratio.
+func PartialRatio(metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error) float64 {
+	if len(metas)+len(partial) == 0 {
+		return 0
+	}
+	return float64(len(partial)) / float64(len(metas)+len(partial))
+}
+
 type MetadataFetcher interface {
 	Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error)
 	UpdateOnChange(func([]metadata.Meta, error))
@@ -149,352 +207,2120 @@ type MetadataFilter interface {
 	Filter(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error
 }
 
+// IndependentMetadataFilter is a MetadataFilter which decision about each block depends only on that block.
+// Consecutive independent filters can be evaluated concurrently, see WithConcurrentFilters.
+type IndependentMetadataFilter interface {
+	MetadataFilter
+
+	// Excludes returns true if the block should be filtered out, along with the synced metric state to account it with.
+	// It must not modify the meta and has to be safe to use concurrently with other filters.
+	Excludes(id ulid.ULID, meta *metadata.Meta) (state string, excluded bool)
+}
+
+// filterIndependent implements MetadataFilter.Filter for IndependentMetadataFilter.
+func filterIndependent(f IndependentMetadataFilter, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) {
+	for id, m := range metas {
+		if state, excluded := f.Excludes(id, m); excluded {
+			synced.WithLabelValues(state).Inc()
+			delete(metas, id)
+		}
+	}
+}
+
+// SyncedStatesMetadataFilter is a MetadataFilter which accounts filtered out blocks in the synced metric with custom
+// states. MetaFetcher initializes those states along with the default ones.
+type SyncedStatesMetadataFilter interface {
+	MetadataFilter
+
+	// SyncedStates returns custom synced metric states used by the filter.
+	SyncedStates() []string
+}
+
+// PartialAwareMetadataFilter is a MetadataFilter which also needs partial blocks of the synchronization, e.g. to find
+// objects left behind deleted blocks.
+type PartialAwareMetadataFilter interface {
+	MetadataFilter
+
+	// SetPartial is called by the MetaFetcher before Filter, with partial blocks of the synchronization. It must not
+	// modify the map.
+	SetPartial(partial map[ulid.ULID]error)
+}
+
 type MetadataModifier interface {
 	Modify(ctx context.Context, metas map[ulid.ULID]*metadata.Meta, modified *extprom.TxGaugeVec) error
 }
 
-// BaseFetcher is a struct that synchronizes filtered metadata of all block in the object storage with the local state.
-// Go-routine safe.
-type BaseFetcher struct {
-	logger      log.Logger
-	concurrency int
-	bkt         objstore.InstrumentedBucketReader
+// PartialPolicy decides which partial blocks (blocks without or with corrupted meta.json) make the fetched view incomplete,
+// the same way as blocks which meta.json failed to be loaded do. Incomplete view is returned with an error and does not update
+// the cache.
+type PartialPolicy int
 
-	// Optional local directory to cache meta.json files.
-	cacheDir string
-	cached   map[ulid.ULID]*metadata.Meta
-	syncs    prometheus.Counter
-	g        singleflight.Group
+const (
+	// PartialPolicyNone means that partial blocks never make the view incomplete. This is the default.
+	PartialPolicyNone PartialPolicy = iota
+	// PartialPolicyCorrupted means that blocks with corrupted meta.json make the view incomplete.
+	PartialPolicyCorrupted
+	// PartialPolicyAll means that all partial blocks, including blocks without meta.json, make the view incomplete.
+	PartialPolicyAll
+)
+
+// incompleteView returns true if given partial error should make the view incomplete.
+func (p PartialPolicy) incompleteView(err error) bool {
+	switch errors.Cause(err) {
+	case ErrorSyncMetaCorrupted, ErrorSyncMetaInvalid:
+		return p >= PartialPolicyCorrupted
+	case ErrorSyncMetaNotFound:
+		return p >= PartialPolicyAll
+	}
+	return false
 }
 
-// NewBaseFetcher constructs BaseFetcher.
-func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer) (*BaseFetcher, error) {
-	if logger == nil {
-		logger = log.NewNopLogger()
+// MetaCache is a cache of blocks metadata that BaseFetcher consults before loading meta.json from the bucket. BaseFetcher
+// uses its in-memory cache and the local disk cache (if cache directory is given) as MetaCache implementations, optionally
+// followed by an external one, e.g. shared by many processes (see WithMetaCache).
+// Implementations have to be go-routine safe and must not modify metas.
+type MetaCache interface {
+	// Get returns cached meta of the block with the given ID, if any.
+	Get(id ulid.ULID) (*metadata.Meta, bool)
+	// Set caches meta of the block with the given ID. Errors should be handled by the implementation, as caching is best effort.
+	Set(id ulid.ULID, m *metadata.Meta)
+}
+
+// BaseFetcherOption configures optional behaviour of the BaseFetcher.
+type BaseFetcherOption func(f *BaseFetcher)
+
+// WithPartialPolicy sets the policy deciding which partial blocks make the fetched view incomplete.
+// By default (PartialPolicyNone) only failures in loading meta.json do.
+func WithPartialPolicy(p PartialPolicy) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.partialPolicy = p
 	}
+}
 
-	cacheDir := ""
-	if dir != "" {
-		cacheDir = filepath.Join(dir, "meta-syncer")
-		if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
-			return nil, err
+// WithCompressedDiskCache makes the BaseFetcher store meta.json files in the local cache directory gzip-compressed,
+// trading a little CPU for disk space. Both formats are read regardless of this option.
+func WithCompressedDiskCache(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.compressCache = enabled
+	}
+}
+
+// WithColdDiskCache adds a second, cold tier of the meta disk cache in the given directory, e.g. on bulk storage. The
+// default cache directory becomes the hot tier, which holds at most hotCapacity most recently accessed metas. Less recently
+// accessed metas are demoted to the cold tier and promoted back to the hot tier on access. Metas of blocks returned by
+// fetches count as accessed on every synchronization. It has no effect without the default cache directory.
+func WithColdDiskCache(dir string, hotCapacity int) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		if dir == "" || hotCapacity <= 0 {
+			return
 		}
+		f.coldCache = &coldDiskCache{dir: dir, hotCapacity: hotCapacity}
 	}
+}
 
-	return &BaseFetcher{
-		logger:      log.With(logger, "component", "block.BaseFetcher"),
-		concurrency: concurrency,
-		bkt:         bkt,
-		cacheDir:    cacheDir,
-		cached:      map[ulid.ULID]*metadata.Meta{},
-		syncs: promauto.With(reg).NewCounter(prometheus.CounterOpts{
-			Subsystem: fetcherSubSys,
-			Name:      "base_syncs_total",
-			Help:      "Total blocks metadata synchronization attempts by base Fetcher",
-		}),
-	}, nil
+// coldDiskCache tracks access recency of metas in the hot tier of the disk cache.
+type coldDiskCache struct {
+	dir         string
+	hotCapacity int
+
+	// viewMtx serializes recency updates from synced views, as concurrent fetches would promote the same metas.
+	viewMtx sync.Mutex
+
+	mtx sync.Mutex
+	// Most recently accessed first.
+	lru *list.List
+	hot map[ulid.ULID]*list.Element
 }
 
-// NewRawMetaFetcher returns basic meta fetcher without proper handling for eventual consistent backends or partial uploads.
-// NOTE: Not suitable to use in production.
-func NewRawMetaFetcher(logger log.Logger, bkt objstore.InstrumentedBucketReader) (*MetaFetcher, error) {
-	return NewMetaFetcher(logger, 1, bkt, "", nil, nil, nil)
+func (c *coldDiskCache) isHot(id ulid.ULID) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	_, ok := c.hot[id]
+	return ok
 }
 
-// NewMetaFetcher returns meta fetcher.
-func NewMetaFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer, filters []MetadataFilter, modifiers []MetadataModifier) (*MetaFetcher, error) {
-	b, err := NewBaseFetcher(logger, concurrency, bkt, dir, reg)
-	if err != nil {
-		return nil, err
+// touch marks the block as the most recently accessed one in the hot tier. It returns the least recently accessed blocks
+// which should be demoted to keep the hot tier within capacity.
+func (c *coldDiskCache) touch(id ulid.ULID) (demoted []ulid.ULID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if e, ok := c.hot[id]; ok {
+		c.lru.MoveToFront(e)
+	} else {
+		c.hot[id] = c.lru.PushFront(id)
 	}
-	return b.NewMetaFetcher(reg, filters, modifiers), nil
+	for c.lru.Len() > c.hotCapacity {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.hot, e.Value.(ulid.ULID))
+		demoted = append(demoted, e.Value.(ulid.ULID))
+	}
+	return demoted
 }
 
-// NewMetaFetcher transforms BaseFetcher into actually usable *MetaFetcher.
-func (f *BaseFetcher) NewMetaFetcher(reg prometheus.Registerer, filters []MetadataFilter, modifiers []MetadataModifier, logTags ...interface{}) *MetaFetcher {
-	return &MetaFetcher{metrics: NewFetcherMetrics(reg, nil, nil), wrapped: f, filters: filters, modifiers: modifiers, logger: log.With(f.logger, logTags...)}
-}
+func (c *coldDiskCache) forget(id ulid.ULID) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 
-var (
-	ErrorSyncMetaNotFound  = errors.New("meta.json not found")
-	ErrorSyncMetaCorrupted = errors.New("meta.json corrupted")
-)
+	if e, ok := c.hot[id]; ok {
+		c.lru.Remove(e)
+		delete(c.hot, id)
+	}
+}
 
-// loadMeta returns metadata from object storage or error.
-// It returns `ErrorSyncMetaNotFound` and `ErrorSyncMetaCorrupted` sentinel errors in those cases.
-func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
-	var (
-		metaFile       = path.Join(id.String(), MetaFilename)
-		cachedBlockDir = filepath.Join(f.cacheDir, id.String())
-	)
+// WithDiskCacheCleanupInterval makes the BaseFetcher remove disk-cached metas of not loaded blocks only on every n-th
+// successful synchronization, instead of every time. This reduces the cost of scanning huge cache directories where
+// stale entries are rare.
+func WithDiskCacheCleanupInterval(n int) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		if n > 0 {
+			f.cleanupInterval = n
+		}
+	}
+}
 
-	// TODO(bwplotka): If that causes problems (obj store rate limits), add longer ttl to cached items.
-	// For 1y and 100 block sources this generates ~1.5-3k HEAD RPM. AWS handles 330k RPM per prefix.
-	// TODO(bwplotka): Consider filtering by consistency delay here (can't do until compactor healthyOverride work).
-	ok, err := f.bkt.Exists(ctx, metaFile)
-	if err != nil {
-		return nil, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
+// WithFetchTimeout bounds the duration of the whole synchronization, including filters and modifiers, so a single sync over
+// a huge bucket can't run unbounded. This is independent of any per-operation timeouts of the bucket.
+// If the timeout expires while listing the bucket, metas loaded so far are returned alongside the incomplete view error,
+// without applying filters and modifiers.
+func WithFetchTimeout(timeout time.Duration) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.fetchTimeout = timeout
 	}
-	if !ok {
-		return nil, ErrorSyncMetaNotFound
+}
+
+// WithClockSkewDetection makes the BaseFetcher detect blocks which ULID time is more than maxSkew ahead of the current time.
+// Such blocks indicate clock skew of the producer and can confuse time based filters (e.g. ConsistencyDelayMetaFilter).
+// They are logged and accounted in the synced metric. If quarantine is true, they are also moved to the partial blocks.
+func WithClockSkewDetection(maxSkew time.Duration, quarantine bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.clockSkew = &clockSkewDetection{maxSkew: maxSkew, quarantine: quarantine}
 	}
+}
+
+type clockSkewDetection struct {
+	maxSkew    time.Duration
+	quarantine bool
+}
 
-	if m, seen := f.cached[id]; seen {
-		return m, nil
+// WithProducerVersionRange makes the BaseFetcher quarantine blocks, which meta.json records the producer version
+// (metadata.Thanos.ProducerVersion) outside of the inclusive [minVersion, maxVersion] range, to the partial blocks.
+// This prevents blocks of a newer producer, e.g. sidecar, from breaking an older reader. Versions are semantic versions,
+// e.g. "0.19.0" or "v0.20.0-rc.1", empty bound means no bound. Blocks without the producer version are compatible, blocks
+// with producer version that can't be parsed are not.
+func WithProducerVersionRange(minVersion, maxVersion string) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.versionRange = &producerVersionRange{minVersion: minVersion, maxVersion: maxVersion}
 	}
+}
 
-	// Best effort load from local dir.
-	if f.cacheDir != "" {
-		m, err := metadata.ReadFromDir(cachedBlockDir)
-		if err == nil {
-			return m, nil
-		}
+type producerVersionRange struct {
+	minVersion, maxVersion string
+	min, max               *semVersion
+}
 
-		if !errors.Is(err, os.ErrNotExist) {
-			level.Warn(f.logger).Log("msg", "best effort read of the local meta.json failed; removing cached block dir", "dir", cachedBlockDir, "err", err)
-			if err := os.RemoveAll(cachedBlockDir); err != nil {
-				level.Warn(f.logger).Log("msg", "best effort remove of cached dir failed; ignoring", "dir", cachedBlockDir, "err", err)
-			}
+func (r *producerVersionRange) parse() (err error) {
+	if r.minVersion != "" {
+		if r.min, err = parseSemVersion(r.minVersion); err != nil {
+			return errors.Wrap(err, "min producer version")
+		}
+	}
+	if r.maxVersion != "" {
+		if r.max, err = parseSemVersion(r.maxVersion); err != nil {
+			return errors.Wrap(err, "max producer version")
 		}
 	}
+	return nil
+}
 
-	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
-	if f.bkt.IsObjNotFoundErr(err) {
-		// Meta.json was deleted between bkt.Exists and here.
-		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
+// check returns an error if the given producer version is outside of the range. Empty version is compatible.
+func (r *producerVersionRange) check(version string) error {
+	if version == "" {
+		return nil
 	}
+	v, err := parseSemVersion(version)
 	if err != nil {
-		return nil, errors.Wrapf(err, "get meta file: %v", metaFile)
+		return err
+	}
+	if r.min != nil && v.compare(r.min) < 0 {
+		return errors.Errorf("producer version %s is older than %s", version, r.minVersion)
 	}
+	if r.max != nil && v.compare(r.max) > 0 {
+		return errors.Errorf("producer version %s is newer than %s", version, r.maxVersion)
+	}
+	return nil
+}
 
-	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
+// semVersion is a parsed semantic version, see https://semver.org.
+type semVersion struct {
+	core       [3]uint64
+	prerelease []string
+}
 
-	metaContent, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
-	}
+// parseSemVersion parses semantic version with optional "v" prefix. Build metadata is ignored.
+func parseSemVersion(s string) (*semVersion, error) {
+	var v semVersion
 
-	m := &metadata.Meta{}
-	if err := json.Unmarshal(metaContent, m); err != nil {
-		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
+	rest := strings.TrimPrefix(s, "v")
+	if i := strings.IndexByte(rest, '+'); i >= 0 {
+		rest = rest[:i]
 	}
-
-	if m.Version != metadata.TSDBVersion1 {
-		return nil, errors.Errorf("unexpected meta file: %s version: %d", metaFile, m.Version)
+	if i := strings.IndexByte(rest, '-'); i >= 0 {
+		v.prerelease = strings.Split(rest[i+1:], ".")
+		rest = rest[:i]
 	}
-
-	// Best effort cache in local dir.
-	if f.cacheDir != "" {
-		if err := os.MkdirAll(cachedBlockDir, os.ModePerm); err != nil {
-			level.Warn(f.logger).Log("msg", "best effort mkdir of the meta.json block dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+	core := strings.Split(rest, ".")
+	if len(core) != len(v.core) {
+		return nil, errors.Errorf("invalid version %q", s)
+	}
+	for i, c := range core {
+		n, err := strconv.ParseUint(c, 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid version %q", s)
 		}
+		v.core[i] = n
+	}
+	for _, p := range v.prerelease {
+		if p == "" {
+			return nil, errors.Errorf("invalid version %q", s)
+		}
+	}
+	return &v, nil
+}
 
-		if err := m.WriteToDir(f.logger, cachedBlockDir); err != nil {
-			level.Warn(f.logger).Log("msg", "best effort save of the meta.json to local dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+// compare returns -1, 0 or 1 if the version has lower, the same or higher precedence than the other one.
+func (v *semVersion) compare(o *semVersion) int {
+	for i := range v.core {
+		if c := compareUint(v.core[i], o.core[i]); c != 0 {
+			return c
 		}
 	}
-	return m, nil
+	// Prerelease version has lower precedence than the release one.
+	switch {
+	case len(v.prerelease) == 0 && len(o.prerelease) == 0:
+		return 0
+	case len(v.prerelease) == 0:
+		return 1
+	case len(o.prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.prerelease) && i < len(o.prerelease); i++ {
+		if c := comparePrerelease(v.prerelease[i], o.prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return compareUint(uint64(len(v.prerelease)), uint64(len(o.prerelease)))
 }
 
-type response struct {
-	metas   map[ulid.ULID]*metadata.Meta
-	partial map[ulid.ULID]error
-	// If metaErr > 0 it means incomplete view, so some metas, failed to be loaded.
-	metaErrs errutil.MultiError
+// comparePrerelease compares prerelease identifiers: numeric ones numerically and with lower precedence than others,
+// which are compared lexically.
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareUint(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
 
-	noMetas        float64
-	corruptedMetas float64
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
 }
 
-func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
-	f.syncs.Inc()
+// WithConcurrentFilters makes the BaseFetcher evaluate consecutive IndependentMetadataFilter filters concurrently.
+// Results are the same as when filters run sequentially.
+func WithConcurrentFilters(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.concurrentFilters = enabled
+	}
+}
 
-	var (
-		resp = response{
-			metas:   make(map[ulid.ULID]*metadata.Meta),
-			partial: make(map[ulid.ULID]error),
-		}
-		eg  errgroup.Group
-		ch  = make(chan ulid.ULID, f.concurrency)
-		mtx sync.Mutex
-	)
-	level.Debug(f.logger).Log("msg", "fetching meta data", "concurrency", f.concurrency)
-	for i := 0; i < f.concurrency; i++ {
-		eg.Go(func() error {
-			for id := range ch {
-				meta, err := f.loadMeta(ctx, id)
-				if err == nil {
-					mtx.Lock()
-					resp.metas[id] = meta
-					mtx.Unlock()
-					continue
-				}
+// WithLenientCacheDir makes the BaseFetcher proceed with the disk cache disabled, instead of failing construction, when
+// the cache directory can't be created (e.g. on read-only filesystem). The disk cache is best effort anyway.
+func WithLenientCacheDir(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.lenientCacheDir = enabled
+	}
+}
 
-				switch errors.Cause(err) {
-				default:
-					mtx.Lock()
-					resp.metaErrs.Add(err)
-					mtx.Unlock()
-					continue
-				case ErrorSyncMetaNotFound:
-					mtx.Lock()
-					resp.noMetas++
-					mtx.Unlock()
-				case ErrorSyncMetaCorrupted:
-					mtx.Lock()
-					resp.corruptedMetas++
-					mtx.Unlock()
-				}
+// WithCachedMetasMemoryLimits sets limits of the estimated memory used by the in-memory cache of metas, in bytes.
+// Exceeding the soft limit is logged. Exceeding the hard limit drops metas with the oldest MinTime from the synced view,
+// also from the incomplete one, until it fits, so those blocks are neither cached nor returned, and accounted in the
+// memory-limit-exceeded synced state. Dropped metas are loaded again (from the disk cache, if any) on every sync, which
+// is counted by the memory limited reloads metric. Zero disables the limit.
+func WithCachedMetasMemoryLimits(soft, hard int64) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.cachedSoftLimit = soft
+		f.cachedHardLimit = hard
+	}
+}
 
-				mtx.Lock()
-				resp.partial[id] = err
-				mtx.Unlock()
-			}
-			return nil
-		})
+// WithFilterValidation makes NewMetaFetcher return an error, and BaseFetcher.NewMetaFetcher log a warning, when given filters
+// are ordered in a known bad way. See ValidateFilters for details.
+func WithFilterValidation(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.validateFilters = enabled
 	}
+}
 
-	// Workers scheduled, distribute blocks.
-	eg.Go(func() error {
-		defer close(ch)
-		return f.bkt.Iter(ctx, "", func(name string) error {
-			id, ok := IsBlockDir(name)
-			if !ok {
-				return nil
-			}
+// WithPartialResultsOnCancel makes Fetch return metas loaded so far, alongside the error, when the context is canceled while
+// listing the bucket, instead of discarding them. Filters and modifiers are not applied to such partial results.
+// This is useful for best effort tooling, e.g. interactive CLI commands.
+func WithPartialResultsOnCancel(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.partialOnCancel = enabled
+	}
+}
 
-			select {
-			case <-ctx.Done():
-				return ctx.Err()
-			case ch <- id:
-			}
+// WithMetaCache sets an additional cache of blocks metadata, consulted after the in-memory and disk caches and before the bucket.
+// Metas loaded from the bucket are put into it, metas found in it are put into the disk cache.
+func WithMetaCache(c MetaCache) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.metaCache = c
+	}
+}
 
-			return nil
-		})
-	})
+// WithMetaValidation makes the BaseFetcher check loaded meta.json files for semantic errors that unmarshal successfully,
+// like zero or inverted time range or negative resolution. If requireLabels is true, blocks without external labels are
+// invalid too. Blocks with invalid meta.json are treated as partial, like blocks with corrupted one, and accounted in
+// the `invalid-meta-json` synced metric.
+func WithMetaValidation(requireLabels bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.metaValidation = &metaValidation{requireLabels: requireLabels}
+	}
+}
 
-	if err := eg.Wait(); err != nil {
-		return nil, errors.Wrap(err, "BaseFetcher: iter bucket")
+type metaValidation struct {
+	requireLabels bool
+}
+
+func (v *metaValidation) validate(m *metadata.Meta) error {
+	if m.MinTime == 0 && m.MaxTime == 0 {
+		return errors.New("time range not set")
 	}
+	if m.MinTime >= m.MaxTime {
+		return errors.Errorf("min time %d is not before max time %d", m.MinTime, m.MaxTime)
+	}
+	if m.Thanos.Downsample.Resolution < 0 {
+		return errors.Errorf("negative resolution %d", m.Thanos.Downsample.Resolution)
+	}
+	if v.requireLabels && len(m.Thanos.Labels) == 0 {
+		return errors.New("no external labels")
+	}
+	return nil
+}
 
-	if len(resp.metaErrs) > 0 {
-		return resp, nil
+// WithStrayFilesCheck makes the BaseFetcher list the directory of every block which meta.json is loaded from the bucket and
+// warn if it contains files other than expected (e.g. temporary files), which suggests incomplete or corrupted upload.
+// It's meant for debugging, as it costs an additional Iter call per block.
+func WithStrayFilesCheck(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.checkStrayFiles = enabled
 	}
+}
 
-	// Only for complete view of blocks update the cache.
-	cached := make(map[ulid.ULID]*metadata.Meta, len(resp.metas))
-	for id, m := range resp.metas {
-		cached[id] = m
+// WithSlowSyncExemplars makes the BaseFetcher attach the trace ID found in the context of Fetch as an exemplar to the
+// sync duration observation, if the sync took at least threshold. Syncs without a trace in context are observed as usual.
+func WithSlowSyncExemplars(threshold time.Duration) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.exemplarThreshold = threshold
+		f.exemplars = true
 	}
-	f.cached = cached
+}
 
-	// Best effort cleanup of disk-cached metas.
-	if f.cacheDir != "" {
-		fis, err := ioutil.ReadDir(f.cacheDir)
-		names := make([]string, 0, len(fis))
-		for _, fi := range fis {
-			names = append(names, fi.Name())
-		}
-		if err != nil {
-			level.Warn(f.logger).Log("msg", "best effort remove of not needed cached dirs failed; ignoring", "err", err)
-		} else {
-			for _, n := range names {
-				id, ok := IsBlockDir(n)
-				if !ok {
-					continue
-				}
+// WithSlowestBlocksTracking makes the BaseFetcher track n blocks which metadata took the longest to load during each
+// synchronization, see MetaFetcher.SlowestBlocks.
+func WithSlowestBlocksTracking(n int) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		f.slowestBlocksN = n
+	}
+}
 
-				if _, ok := resp.metas[id]; ok {
-					continue
-				}
+// BlockTiming is the duration of loading the metadata of the block.
+type BlockTiming struct {
+	ID       ulid.ULID
+	Duration time.Duration
+}
 
-				cachedBlockDir := filepath.Join(f.cacheDir, id.String())
+// slowestBlocks keeps n slowest block timings, using min-heap so only n timings are retained.
+type slowestBlocks struct {
+	n int
 
-				// No such block loaded, remove the local dir.
-				if err := os.RemoveAll(cachedBlockDir); err != nil {
-					level.Warn(f.logger).Log("msg", "best effort remove of not needed cached dir failed; ignoring", "dir", cachedBlockDir, "err", err)
-				}
-			}
-		}
-	}
-	return resp, nil
+	mtx     sync.Mutex
+	timings blockTimingHeap
 }
 
-func (f *BaseFetcher) fetch(ctx context.Context, metrics *FetcherMetrics, filters []MetadataFilter, modifiers []MetadataModifier) (_ map[ulid.ULID]*metadata.Meta, _ map[ulid.ULID]error, err error) {
-	start := time.Now()
-	defer func() {
-		metrics.SyncDuration.Observe(time.Since(start).Seconds())
-		if err != nil {
-			metrics.SyncFailures.Inc()
-		}
-	}()
-	metrics.Syncs.Inc()
-	metrics.ResetTx()
+func newSlowestBlocks(n int) *slowestBlocks {
+	return &slowestBlocks{n: n, timings: make(blockTimingHeap, 0, n)}
+}
 
-	// Run this in thread safe run group.
-	// TODO(bwplotka): Consider custom singleflight with ttl.
-	v, err := f.g.Do("", func() (i interface{}, err error) {
-		// NOTE: First go routine context will go through.
-		return f.fetchMetadata(ctx)
-	})
-	if err != nil {
-		return nil, nil, err
-	}
-	resp := v.(response)
+func (s *slowestBlocks) observe(id ulid.ULID, d time.Duration) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
 
-	// Copy as same response might be reused by different goroutines.
-	metas := make(map[ulid.ULID]*metadata.Meta, len(resp.metas))
-	for id, m := range resp.metas {
-		metas[id] = m
+	if len(s.timings) < s.n {
+		heap.Push(&s.timings, BlockTiming{ID: id, Duration: d})
+		return
+	}
+	if d > s.timings[0].Duration {
+		s.timings[0] = BlockTiming{ID: id, Duration: d}
+		heap.Fix(&s.timings, 0)
 	}
+}
 
-	metrics.Synced.WithLabelValues(FailedMeta).Set(float64(len(resp.metaErrs)))
-	metrics.Synced.WithLabelValues(NoMeta).Set(resp.noMetas)
-	metrics.Synced.WithLabelValues(CorruptedMeta).Set(resp.corruptedMetas)
+// sorted returns timings, the slowest first.
+func (s *slowestBlocks) sorted() []BlockTiming {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	res := make([]BlockTiming, len(s.timings))
+	copy(res, s.timings)
+	sort.Slice(res, func(i, j int) bool { return res[i].Duration > res[j].Duration })
+	return res
+}
+
+type blockTimingHeap []BlockTiming
+
+func (h blockTimingHeap) Len() int            { return len(h) }
+func (h blockTimingHeap) Less(i, j int) bool  { return h[i].Duration < h[j].Duration }
+func (h blockTimingHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *blockTimingHeap) Push(x interface{}) { *h = append(*h, x.(BlockTiming)) }
+func (h *blockTimingHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// BlockDirPredicate returns the ID of the block if the given name listed in the bucket root is a block directory.
+type BlockDirPredicate func(name string) (ulid.ULID, bool)
+
+// WithBlockDirPredicate makes the BaseFetcher consider only names matching the given predicate as block directories,
+// instead of all names parseable as ULID (IsBlockDir). This allows e.g. skipping ULID-shaped names not meant to be loaded.
+// As the bucket listing is shared, it applies to all MetaFetchers created from the BaseFetcher.
+func WithBlockDirPredicate(p BlockDirPredicate) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		if p != nil {
+			f.isBlockDir = p
+		}
+	}
+}
+
+// WithConsolidatedWarnings makes the BaseFetcher collapse warnings of best effort operations (e.g. disk cache writes)
+// failing for the same reason during a single synchronization into one warning with the number of failures, logged at the
+// end of the synchronization. This avoids flooding logs when e.g. the cache directory is broken for all blocks.
+func WithConsolidatedWarnings(enabled bool) BaseFetcherOption {
+	return func(f *BaseFetcher) {
+		if enabled {
+			f.warnings = &consolidatedWarnings{}
+		} else {
+			f.warnings = nil
+		}
+	}
+}
+
+// consolidatedWarnings collects warnings by message while active.
+type consolidatedWarnings struct {
+	mtx    sync.Mutex
+	active bool
+	// Messages in order of the first occurrence.
+	msgs  []string
+	byMsg map[string]*consolidatedWarning
+}
+
+type consolidatedWarning struct {
+	count int
+	// Key-values of the first occurrence.
+	keyvals []interface{}
+}
+
+func (w *consolidatedWarnings) begin() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.active = true
+	w.msgs = w.msgs[:0]
+	w.byMsg = map[string]*consolidatedWarning{}
+}
+
+// add returns false if the warning was not collected, because collection is not active.
+func (w *consolidatedWarnings) add(msg string, keyvals []interface{}) bool {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if !w.active {
+		return false
+	}
+	if cw, ok := w.byMsg[msg]; ok {
+		cw.count++
+		return true
+	}
+	w.msgs = append(w.msgs, msg)
+	w.byMsg[msg] = &consolidatedWarning{count: 1, keyvals: keyvals}
+	return true
+}
+
+// flush logs collected warnings, one per message, and stops collection.
+func (w *consolidatedWarnings) flush(logger log.Logger) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, msg := range w.msgs {
+		cw := w.byMsg[msg]
+		level.Warn(logger).Log(append([]interface{}{"msg", msg, "count", cw.count}, cw.keyvals...)...)
+	}
+	w.active = false
+	w.msgs = w.msgs[:0]
+	w.byMsg = nil
+}
+
+// BaseFetcher is a struct that synchronizes filtered metadata of all block in the object storage with the local state.
+// Go-routine safe.
+type BaseFetcher struct {
+	logger        log.Logger
+	concurrency   int
+	bkt           objstore.InstrumentedBucketReader
+	isBlockDir    BlockDirPredicate
+	partialPolicy PartialPolicy
+	fetchTimeout  time.Duration
+	clockSkew     *clockSkewDetection
+	versionRange  *producerVersionRange
+	// Optional validation of loaded metas.
+	metaValidation *metaValidation
+	// If true, consecutive independent filters are evaluated concurrently.
+	concurrentFilters bool
+	validateFilters   bool
+	partialOnCancel   bool
+	checkStrayFiles   bool
+	// Optional consolidation of best effort warnings, per synchronization.
+	warnings *consolidatedWarnings
+	// Number of the slowest blocks tracked, 0 means disabled.
+	slowestBlocksN int
+	slowestMtx     sync.Mutex
+	slowest        []BlockTiming
+	// If true, slow syncs are observed with trace ID exemplar.
+	exemplars         bool
+	exemplarThreshold time.Duration
+
+	// Optional local directory to cache meta.json files.
+	cacheDir        string
+	lenientCacheDir bool
+	compressCache   bool
+	cachedMtx       sync.RWMutex
+	cached          map[ulid.ULID]*metadata.Meta
+	// Metas dropped from the cache by the memory limit during the last sync.
+	memLimited map[ulid.ULID]struct{}
+	// Persists written cached meta before it's renamed into place.
+	syncFile func(*os.File) error
+	// Optional cold tier of the disk cache.
+	coldCache *coldDiskCache
+	// Optional external cache of metas, consulted after in-memory and disk caches.
+	metaCache MetaCache
+	// Caches consulted in order before loading meta from the bucket.
+	metaCaches []MetaCache
+	// Limits of the estimated memory used by cached metas in bytes, 0 means no limit.
+	cachedSoftLimit int64
+	cachedHardLimit int64
+	// Disk cache is cleaned up every cleanupInterval successful syncs.
+	cleanupInterval int
+	successfulSyncs int
+
+	syncs            prometheus.Counter
+	iterBlocked      prometheus.Counter
+	cachedMetasBytes prometheus.Gauge
+	// Counts metas loaded again, because they were dropped from the cache by the memory limit.
+	memLimitedReloads prometheus.Counter
+	decodeDuration    prometheus.Histogram
+	// Counts names of block directories returned by Iter in other than the expected "<ULID>/" form.
+	nonCanonicalNames prometheus.Counter
+	g                 singleflight.Group
+}
+
+// NewBaseFetcher constructs BaseFetcher.
+func NewBaseFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer, opts ...BaseFetcherOption) (*BaseFetcher, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+
+	f := &BaseFetcher{
+		logger:          log.With(logger, "component", "block.BaseFetcher"),
+		concurrency:     concurrency,
+		bkt:             bkt,
+		isBlockDir:      IsBlockDir,
+		syncFile:        (*os.File).Sync,
+		cached:          map[ulid.ULID]*metadata.Meta{},
+		cleanupInterval: 1,
+	}
+	for _, o := range opts {
+		o(f)
+	}
+
+	if dir != "" {
+		cacheDir := filepath.Join(dir, "meta-syncer")
+		if err := os.MkdirAll(cacheDir, os.ModePerm); err != nil {
+			if !f.lenientCacheDir {
+				return nil, err
+			}
+			level.Warn(f.logger).Log("msg", "failed to create cache directory, proceeding with disk cache disabled", "dir", cacheDir, "err", err)
+		} else {
+			f.cacheDir = cacheDir
+		}
+	}
+	if f.versionRange != nil {
+		if err := f.versionRange.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if f.coldCache != nil {
+		if err := f.initColdDiskCache(); err != nil {
+			if !f.lenientCacheDir {
+				return nil, err
+			}
+			level.Warn(f.logger).Log("msg", "failed to create cold cache directory, proceeding with cold tier disabled", "dir", f.coldCache.dir, "err", err)
+			f.coldCache = nil
+		}
+	}
+	f.metaCaches = []MetaCache{memoryMetaCache{f}}
+	if f.cacheDir != "" {
+		f.metaCaches = append(f.metaCaches, diskMetaCache{f})
+	}
+	if f.metaCache != nil {
+		f.metaCaches = append(f.metaCaches, f.metaCache)
+	}
+
+	f.syncs = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_syncs_total",
+		Help:      "Total blocks metadata synchronization attempts by base Fetcher",
+	})
+	f.iterBlocked = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_iter_blocked_total",
+		Help:      "Total number of times bucket iteration was blocked on workers loading blocks metadata. Steady increase means synchronization is bottlenecked on loading rather than listing blocks",
+	})
+	f.cachedMetasBytes = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_cached_metas_bytes",
+		Help:      "Estimated number of bytes of memory held by the in-memory cache of blocks metadata.",
+	})
+	f.memLimitedReloads = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_memory_limited_reloads_total",
+		Help:      "Total number of blocks metadata loaded again, because they were dropped from the in-memory cache by the memory hard limit.",
+	})
+	f.decodeDuration = promauto.With(reg).NewHistogram(prometheus.HistogramOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_meta_decode_duration_seconds",
+		Help:      "Duration of decoding meta.json files fetched from the bucket in seconds, excluding the time of fetching them.",
+		Buckets:   []float64{0.0001, 0.001, 0.01, 0.1, 1},
+	})
+	f.nonCanonicalNames = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Subsystem: fetcherSubSys,
+		Name:      "base_non_canonical_block_dir_names_total",
+		Help:      "Total number of block directory names returned by the bucket listing in other than the <ULID>/ form, e.g. without trailing slash or with a prefix. Useful for debugging bucket implementations",
+	})
+	return f, nil
+}
+
+// NewRawMetaFetcher returns basic meta fetcher without proper handling for eventual consistent backends or partial uploads.
+// NOTE: Not suitable to use in production.
+func NewRawMetaFetcher(logger log.Logger, bkt objstore.InstrumentedBucketReader) (*MetaFetcher, error) {
+	return NewMetaFetcher(logger, 1, bkt, "", nil, nil, nil)
+}
+
+// NewMetaFetcher returns meta fetcher.
+func NewMetaFetcher(logger log.Logger, concurrency int, bkt objstore.InstrumentedBucketReader, dir string, reg prometheus.Registerer, filters []MetadataFilter, modifiers []MetadataModifier, opts ...BaseFetcherOption) (*MetaFetcher, error) {
+	b, err := NewBaseFetcher(logger, concurrency, bkt, dir, reg, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if b.validateFilters {
+		if err := ValidateFilters(filters); err != nil {
+			return nil, errors.Wrap(err, "validate filters")
+		}
+	}
+	return b.NewMetaFetcher(reg, filters, modifiers), nil
+}
+
+// NewMetaFetcher transforms BaseFetcher into actually usable *MetaFetcher.
+// If filters validation is enabled, known bad ordering of filters is logged.
+func (f *BaseFetcher) NewMetaFetcher(reg prometheus.Registerer, filters []MetadataFilter, modifiers []MetadataModifier, logTags ...interface{}) *MetaFetcher {
+	if f.validateFilters {
+		if err := ValidateFilters(filters); err != nil {
+			level.Warn(f.logger).Log("msg", "bad filters configuration", "err", err)
+		}
+	}
+	var syncedExtraLabels [][]string
+	for _, filter := range filters {
+		if sf, ok := filter.(SyncedStatesMetadataFilter); ok {
+			for _, state := range sf.SyncedStates() {
+				syncedExtraLabels = append(syncedExtraLabels, []string{state})
+			}
+		}
+	}
+	return &MetaFetcher{metrics: NewFetcherMetrics(reg, syncedExtraLabels, nil), wrapped: f, filters: filters, modifiers: modifiers, logger: log.With(f.logger, logTags...)}
+}
+
+var (
+	ErrorSyncMetaNotFound    = errors.New("meta.json not found")
+	ErrorSyncMetaCorrupted   = errors.New("meta.json corrupted")
+	ErrorSyncMetaClockSkewed = errors.New("block ULID time is in the future")
+	ErrorSyncMetaInvalid     = errors.New("meta.json invalid")
+	// ErrorSyncMetaIncompatibleVersion is the partial error of blocks produced by Thanos version outside of the
+	// compatible range, see WithProducerVersionRange.
+	ErrorSyncMetaIncompatibleVersion = errors.New("block produced by incompatible Thanos version")
+)
+
+// memoryMetaCache is the MetaCache of metas held in memory by the BaseFetcher. It's replaced with the metas of every
+// synchronization, so Set is a no-op.
+type memoryMetaCache struct {
+	f *BaseFetcher
+}
+
+func (c memoryMetaCache) Get(id ulid.ULID) (*metadata.Meta, bool) {
+	c.f.cachedMtx.RLock()
+	defer c.f.cachedMtx.RUnlock()
+
+	m, ok := c.f.cached[id]
+	return m, ok
+}
+
+func (c memoryMetaCache) Set(ulid.ULID, *metadata.Meta) {}
+
+// diskMetaCache is the MetaCache of metas in the local cache directory, including its optional cold tier.
+type diskMetaCache struct {
+	f *BaseFetcher
+}
+
+func (c diskMetaCache) Get(id ulid.ULID) (*metadata.Meta, bool) {
+	cachedBlockDir := filepath.Join(c.f.cacheDir, id.String())
+	m, err := c.f.readCachedMeta(cachedBlockDir)
+	if err == nil {
+		c.f.touchHotCachedMeta(id)
+		return m, true
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		c.f.warnBestEffort("best effort read of the local meta.json failed; removing cached block dir", "dir", cachedBlockDir, "err", err)
+		if err := os.RemoveAll(cachedBlockDir); err != nil {
+			c.f.warnBestEffort("best effort remove of cached dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+		}
+	}
+	return c.f.loadColdCachedMeta(id)
+}
+
+func (c diskMetaCache) Set(id ulid.ULID, m *metadata.Meta) {
+	c.f.cacheOnDisk(filepath.Join(c.f.cacheDir, id.String()), m)
+	c.f.touchHotCachedMeta(id)
+}
+
+// loadMeta returns metadata from object storage or error.
+// It returns `ErrorSyncMetaNotFound` and `ErrorSyncMetaCorrupted` sentinel errors in those cases.
+func (f *BaseFetcher) loadMeta(ctx context.Context, id ulid.ULID) (*metadata.Meta, error) {
+	metaFile := path.Join(id.String(), MetaFilename)
+
+	// TODO(bwplotka): If that causes problems (obj store rate limits), add longer ttl to cached items.
+	// For 1y and 100 block sources this generates ~1.5-3k HEAD RPM. AWS handles 330k RPM per prefix.
+	// TODO(bwplotka): Consider filtering by consistency delay here (can't do until compactor healthyOverride work).
+	ok, err := f.bkt.Exists(ctx, metaFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "meta.json file exists: %v", metaFile)
+	}
+	if !ok {
+		return nil, ErrorSyncMetaNotFound
+	}
+
+	f.cachedMtx.RLock()
+	_, memLimited := f.memLimited[id]
+	f.cachedMtx.RUnlock()
+	if memLimited {
+		f.memLimitedReloads.Inc()
+	}
+
+	for i, c := range f.metaCaches {
+		if m, ok := c.Get(id); ok {
+			// Fill caches consulted before, e.g. disk cache with metas from the external one.
+			for _, prev := range f.metaCaches[:i] {
+				prev.Set(id, m)
+			}
+			return m, nil
+		}
+	}
+
+	r, err := f.bkt.ReaderWithExpectedErrs(f.bkt.IsObjNotFoundErr).Get(ctx, metaFile)
+	if f.bkt.IsObjNotFoundErr(err) {
+		// Meta.json was deleted between bkt.Exists and here.
+		return nil, errors.Wrapf(ErrorSyncMetaNotFound, "%v", err)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "get meta file: %v", metaFile)
+	}
+
+	defer runutil.CloseWithLogOnErr(f.logger, r, "close bkt meta get")
+
+	metaContent, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read meta file: %v", metaFile)
+	}
+
+	m := &metadata.Meta{}
+	decodeStart := time.Now()
+	err = json.Unmarshal(metaContent, m)
+	f.decodeDuration.Observe(time.Since(decodeStart).Seconds())
+	if err != nil {
+		return nil, errors.Wrapf(ErrorSyncMetaCorrupted, "meta.json %v unmarshal: %v", metaFile, err)
+	}
+
+	if m.Version != metadata.TSDBVersion1 {
+		return nil, errors.Errorf("unexpected meta file: %s version: %d", metaFile, m.Version)
+	}
+
+	if f.checkStrayFiles {
+		// Only for blocks loaded from the bucket, so the check runs once per block, not every sync.
+		f.warnStrayFiles(ctx, id)
+	}
+
+	for _, c := range f.metaCaches {
+		c.Set(id, m)
+	}
+	return m, nil
+}
+
+// expectedBlockFiles are names of files and directories expected in the block directory in the bucket.
+var expectedBlockFiles = map[string]struct{}{
+	MetaFilename:                   {},
+	IndexFilename:                  {},
+	ChunksDirname + "/":            {},
+	"tombstones":                   {},
+	metadata.DeletionMarkFilename:  {},
+	metadata.NoCompactMarkFilename: {},
+}
+
+// warnStrayFiles logs a warning if the block directory contains unexpected files, e.g. temporary files left by an interrupted upload.
+func (f *BaseFetcher) warnStrayFiles(ctx context.Context, id ulid.ULID) {
+	var stray []string
+	if err := f.bkt.Iter(ctx, id.String()+"/", func(name string) error {
+		if _, ok := expectedBlockFiles[strings.TrimPrefix(name, id.String()+"/")]; !ok {
+			stray = append(stray, name)
+		}
+		return nil
+	}); err != nil {
+		f.warnBestEffort("best effort listing of the block dir failed; ignoring", "block", id, "err", err)
+		return
+	}
+	if len(stray) > 0 {
+		level.Warn(f.logger).Log("msg", "block dir contains unexpected files; upload might be incomplete or corrupted", "block", id, "files", strings.Join(stray, ","))
+	}
+}
+
+// cacheOnDisk saves meta.json into the local cache directory, if any. Best effort.
+func (f *BaseFetcher) cacheOnDisk(cachedBlockDir string, m *metadata.Meta) {
+	if f.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(cachedBlockDir, os.ModePerm); err != nil {
+		f.warnBestEffort("best effort mkdir of the meta.json block dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+	}
+
+	if err := f.writeCachedMeta(cachedBlockDir, m); err != nil {
+		f.warnBestEffort("best effort save of the meta.json to local dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+		// Don't leave partially written temporary files behind.
+		for _, tmp := range []string{MetaFilename + ".tmp", cachedMetaGzipFilename + ".tmp"} {
+			if err := os.Remove(filepath.Join(cachedBlockDir, tmp)); err != nil && !os.IsNotExist(err) {
+				f.warnBestEffort("best effort remove of temporary meta file failed; ignoring", "dir", cachedBlockDir, "err", err)
+			}
+		}
+	}
+}
+
+// warnBestEffort logs warning about failed best effort operation, unless it's consolidated.
+func (f *BaseFetcher) warnBestEffort(msg string, keyvals ...interface{}) {
+	if f.warnings != nil && f.warnings.add(msg, keyvals) {
+		return
+	}
+	level.Warn(f.logger).Log(append([]interface{}{"msg", msg}, keyvals...)...)
+}
+
+// loadMetas iterates over all blocks in the bucket and loads their metadata using f.concurrency workers.
+// Given function is called concurrently with the result for every block found.
+// If timings is not nil, durations of loading metadata are observed there.
+func (f *BaseFetcher) loadMetas(ctx context.Context, timings *slowestBlocks, fn func(id ulid.ULID, meta *metadata.Meta, err error)) error {
+	var (
+		eg errgroup.Group
+		ch = make(chan ulid.ULID, f.concurrency)
+	)
+	for i := 0; i < f.concurrency; i++ {
+		eg.Go(func() error {
+			for id := range ch {
+				var start time.Time
+				if timings != nil {
+					start = time.Now()
+				}
+				meta, err := f.loadMeta(ctx, id)
+				if timings != nil {
+					timings.observe(id, time.Since(start))
+				}
+				if err == nil && f.metaValidation != nil {
+					if verr := f.metaValidation.validate(meta); verr != nil {
+						meta, err = nil, errors.Wrapf(ErrorSyncMetaInvalid, "meta.json of %v: %v", id, verr)
+					}
+				}
+				fn(id, meta, err)
+			}
+			return nil
+		})
+	}
+
+	// Workers scheduled, distribute blocks.
+	eg.Go(func() error {
+		defer close(ch)
+
+		seen := map[ulid.ULID]struct{}{}
+		return f.bkt.Iter(ctx, "", func(name string) error {
+			id, ok := f.isBlockDir(name)
+			if !ok {
+				return nil
+			}
+			// Some backends or prefixing wrappers return block directories without trailing slash or with the prefix,
+			// possibly alongside the expected form. Load every block once regardless.
+			if name != id.String()+objstore.DirDelim {
+				f.nonCanonicalNames.Inc()
+			}
+			if _, ok := seen[id]; ok {
+				return nil
+			}
+			seen[id] = struct{}{}
+
+			select {
+			case ch <- id:
+				return nil
+			default:
+				// All workers are busy and the queue is full.
+				f.iterBlocked.Inc()
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ch <- id:
+			}
+
+			return nil
+		})
+	})
+	return eg.Wait()
+}
+
+// MetaOrError is the result of loading metadata of a single block, as emitted by FetchStream.
+type MetaOrError struct {
+	ID   ulid.ULID
+	Meta *metadata.Meta
+	// Err is not nil if block metadata could not be loaded. For partial blocks, the cause is ErrorSyncMetaNotFound,
+	// ErrorSyncMetaCorrupted or ErrorSyncMetaInvalid. If ID is empty, the error comes from iterating over the bucket and it is the last item emitted.
+	Err error
+}
+
+// FetchStream emits metadata of all blocks in the bucket one by one as they are loaded, so the caller can process them
+// without holding all of them in memory. Every block is emitted exactly once. The returned channel is closed once all blocks
+// are processed or the context is canceled.
+// NOTE: Filters and modifiers are not applied, since many of them (e.g. DeduplicateFilter) need the global view of all blocks.
+// The in-memory cache is used, but not updated.
+func (f *BaseFetcher) FetchStream(ctx context.Context) (<-chan MetaOrError, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan MetaOrError, f.concurrency)
+	send := func(r MetaOrError) {
+		select {
+		case <-ctx.Done():
+		case ch <- r:
+		}
+	}
+	go func() {
+		defer close(ch)
+
+		if err := f.loadMetas(ctx, nil, func(id ulid.ULID, meta *metadata.Meta, err error) {
+			send(MetaOrError{ID: id, Meta: meta, Err: err})
+		}); err != nil {
+			send(MetaOrError{Err: errors.Wrap(err, "BaseFetcher: iter bucket")})
+		}
+	}()
+	return ch, nil
+}
+
+// cachedMetaGzipFilename is the name of gzip-compressed meta.json file in the local cache directory.
+const cachedMetaGzipFilename = MetaFilename + ".gz"
+
+// readCachedMeta reads meta.json from the given local cache directory. It auto-detects whether the file is compressed,
+// preferring the format currently configured.
+func (f *BaseFetcher) readCachedMeta(dir string) (*metadata.Meta, error) {
+	if !f.compressCache {
+		m, err := metadata.ReadFromDir(dir)
+		if !errors.Is(err, os.ErrNotExist) {
+			return m, err
+		}
+		return readGzipMeta(dir)
+	}
+
+	m, err := readGzipMeta(dir)
+	if !errors.Is(err, os.ErrNotExist) {
+		return m, err
+	}
+	return metadata.ReadFromDir(dir)
+}
+
+func readGzipMeta(dir string) (_ *metadata.Meta, err error) {
+	file, err := os.Open(filepath.Join(dir, cachedMetaGzipFilename))
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithErrCapture(&err, file, "close gzip meta file")
+
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "gzip reader")
+	}
+	return metadata.Read(r)
+}
+
+// writeCachedMeta writes meta.json into the given local cache directory in the configured format.
+func (f *BaseFetcher) writeCachedMeta(dir string, m *metadata.Meta) error {
+	filename := MetaFilename
+	if f.compressCache {
+		filename = cachedMetaGzipFilename
+	}
+
+	// Make any changes to the file appear atomic.
+	path := filepath.Join(dir, filename)
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := f.encodeCachedMeta(file, m); err != nil {
+		runutil.CloseWithLogOnErr(f.logger, file, "close cached meta")
+		return err
+	}
+	// Persist the content before rename, so a crash can't leave truncated file in place.
+	if err := f.syncFile(file); err != nil {
+		runutil.CloseWithLogOnErr(f.logger, file, "close cached meta")
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *BaseFetcher) encodeCachedMeta(w io.Writer, m *metadata.Meta) error {
+	if !f.compressCache {
+		return m.Write(w)
+	}
+	gw := gzip.NewWriter(w)
+	if err := m.Write(gw); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// errFetchTimedOut is the cause of the context canceled by WithFetchTimeout.
+var errFetchTimedOut = errors.New("fetch timed out")
+
+// fetchTimedOut returns true if the context was canceled by WithFetchTimeout, not by its parent.
+func fetchTimedOut(ctx context.Context) bool {
+	return ctx.Err() != nil && context.Cause(ctx) == errFetchTimedOut
+}
+
+type response struct {
+	metas   map[ulid.ULID]*metadata.Meta
+	partial map[ulid.ULID]error
+	// If metaErr > 0 it means incomplete view, so some metas, failed to be loaded.
+	metaErrs errutil.MultiError
+	// If partialErrs > 0 it means incomplete view, so some partial blocks are not accepted by PartialPolicy.
+	partialErrs errutil.MultiError
+
+	noMetas          float64
+	corruptedMetas   float64
+	invalidMetas     float64
+	clockSkewedMetas float64
+	memLimitedMetas  float64
+
+	incompatibleVersionMetas float64
+}
+
+func (r response) incompleteView() bool {
+	return len(r.metaErrs) > 0 || len(r.partialErrs) > 0
+}
+
+func (f *BaseFetcher) fetchMetadata(ctx context.Context) (interface{}, error) {
+	f.syncs.Inc()
+	if f.warnings != nil {
+		f.warnings.begin()
+		defer f.warnings.flush(f.logger)
+	}
+
+	var (
+		resp = response{
+			metas:   make(map[ulid.ULID]*metadata.Meta),
+			partial: make(map[ulid.ULID]error),
+		}
+		mtx sync.Mutex
+		now = ulid.Now()
+	)
+	var timings *slowestBlocks
+	if f.slowestBlocksN > 0 {
+		timings = newSlowestBlocks(f.slowestBlocksN)
+		defer func() {
+			f.slowestMtx.Lock()
+			f.slowest = timings.sorted()
+			f.slowestMtx.Unlock()
+		}()
+	}
+
+	level.Debug(f.logger).Log("msg", "fetching meta data", "concurrency", f.concurrency)
+	if err := f.loadMetas(ctx, timings, func(id ulid.ULID, meta *metadata.Meta, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if err == nil && f.clockSkew != nil && id.Time() > now+uint64(f.clockSkew.maxSkew/time.Millisecond) {
+			level.Warn(f.logger).Log("msg", "block ULID time is in the future; producer clock might be skewed", "block", id, "ahead", time.Duration(id.Time()-now)*time.Millisecond, "quarantined", f.clockSkew.quarantine)
+			resp.clockSkewedMetas++
+			if f.clockSkew.quarantine {
+				resp.partial[id] = errors.Wrapf(ErrorSyncMetaClockSkewed, "%v", id)
+				return
+			}
+		}
+
+		if err == nil && f.versionRange != nil {
+			if verr := f.versionRange.check(meta.Thanos.ProducerVersion); verr != nil {
+				resp.incompatibleVersionMetas++
+				resp.partial[id] = errors.Wrapf(ErrorSyncMetaIncompatibleVersion, "%v: %v", id, verr)
+				return
+			}
+		}
+
+		if err == nil {
+			resp.metas[id] = meta
+			return
+		}
+
+		switch errors.Cause(err) {
+		default:
+			resp.metaErrs.Add(err)
+			return
+		case ErrorSyncMetaNotFound:
+			resp.noMetas++
+		case ErrorSyncMetaCorrupted:
+			resp.corruptedMetas++
+		case ErrorSyncMetaInvalid:
+			resp.invalidMetas++
+		}
+
+		resp.partial[id] = err
+		if f.partialPolicy.incompleteView(err) {
+			resp.partialErrs.Add(err)
+		}
+	}); err != nil {
+		err = errors.Wrap(err, "BaseFetcher: iter bucket")
+		if (f.partialOnCancel && ctx.Err() != nil) || fetchTimedOut(ctx) {
+			// Return metas loaded so far alongside the error.
+			return resp, err
+		}
+		return nil, err
+	}
+
+	if resp.incompleteView() {
+		// Cache is not updated, but the returned view has to fit the memory limit too.
+		dropped, _ := f.limitCachedMetas(resp.metas)
+		resp.memLimitedMetas = float64(len(dropped))
+		return resp, nil
+	}
+
+	// Only for complete view of blocks update the cache.
+	cached := make(map[ulid.ULID]*metadata.Meta, len(resp.metas))
+	for id, m := range resp.metas {
+		cached[id] = m
+	}
+
+	// Best effort cleanup of disk-cached metas. Metas dropped by the memory limit are kept on disk, as they are synced.
+	if f.cacheDir != "" {
+		if f.successfulSyncs%f.cleanupInterval == 0 {
+			f.cleanUpCacheDir(resp.metas)
+		}
+		f.successfulSyncs++
+	}
+
+	dropped, size := f.limitCachedMetas(cached)
+	memLimited := make(map[ulid.ULID]struct{}, len(dropped))
+	for _, id := range dropped {
+		delete(resp.metas, id)
+		memLimited[id] = struct{}{}
+	}
+	resp.memLimitedMetas = float64(len(dropped))
+	f.cachedMetasBytes.Set(float64(size))
+
+	f.cachedMtx.Lock()
+	f.cached = cached
+	f.memLimited = memLimited
+	f.cachedMtx.Unlock()
+	return resp, nil
+}
+
+// limitCachedMetas enforces memory limits, if any, on given metas. Metas exceeding the hard limit are deleted from given
+// map and returned, along with the estimate of memory used by the remaining ones.
+func (f *BaseFetcher) limitCachedMetas(cached map[ulid.ULID]*metadata.Meta) (dropped []ulid.ULID, size int64) {
+	for _, m := range cached {
+		size += estimateMetaSize(m)
+	}
+
+	if f.cachedHardLimit > 0 && size > f.cachedHardLimit {
+		oldest := make([]*metadata.Meta, 0, len(cached))
+		for _, m := range cached {
+			oldest = append(oldest, m)
+		}
+		sort.Slice(oldest, func(i, j int) bool {
+			if oldest[i].MinTime == oldest[j].MinTime {
+				return oldest[i].ULID.Compare(oldest[j].ULID) < 0
+			}
+			return oldest[i].MinTime < oldest[j].MinTime
+		})
+
+		for _, m := range oldest {
+			if size <= f.cachedHardLimit {
+				break
+			}
+			delete(cached, m.ULID)
+			size -= estimateMetaSize(m)
+			dropped = append(dropped, m.ULID)
+		}
+		level.Error(f.logger).Log("msg", "cached metas exceed memory hard limit; blocks with the oldest MinTime are dropped from the synced view and won't be queried",
+			"limit_bytes", f.cachedHardLimit, "dropped", len(dropped))
+	}
+	if f.cachedSoftLimit > 0 && size > f.cachedSoftLimit {
+		level.Warn(f.logger).Log("msg", "cached metas exceed memory soft limit", "limit_bytes", f.cachedSoftLimit, "estimated_bytes", size, "cached", len(cached))
+	}
+	return dropped, size
+}
+
+// estimateMetaSize returns approximate number of bytes held in memory by given meta.
+func estimateMetaSize(m *metadata.Meta) int64 {
+	size := int64(unsafe.Sizeof(*m))
+	for k, v := range m.Thanos.Labels {
+		size += 2*int64(unsafe.Sizeof("")) + int64(len(k)+len(v))
+	}
+	size += int64(len(m.Compaction.Sources)) * int64(unsafe.Sizeof(ulid.ULID{}))
+	size += int64(len(m.Compaction.Parents)) * int64(unsafe.Sizeof(tsdb.BlockDesc{}))
+	for _, f := range m.Thanos.Files {
+		size += int64(unsafe.Sizeof(f)) + int64(len(f.RelPath))
+		if f.Hash != nil {
+			size += int64(unsafe.Sizeof(*f.Hash)) + int64(len(f.Hash.Value))
+		}
+	}
+	for _, sf := range m.Thanos.SegmentFiles {
+		size += int64(unsafe.Sizeof(sf)) + int64(len(sf))
+	}
+	return size
+}
+
+// initColdDiskCache creates the cold tier directory and starts tracking metas already cached in the hot tier, the most
+// recently modified being the most recently accessed ones.
+func (f *BaseFetcher) initColdDiskCache() error {
+	if f.cacheDir == "" {
+		f.coldCache = nil
+		return nil
+	}
+
+	coldDir := filepath.Join(f.coldCache.dir, "meta-syncer")
+	if err := os.MkdirAll(coldDir, os.ModePerm); err != nil {
+		return err
+	}
+	f.coldCache.dir = coldDir
+	f.coldCache.lru = list.New()
+	f.coldCache.hot = map[ulid.ULID]*list.Element{}
+
+	fis, err := ioutil.ReadDir(f.cacheDir)
+	if err != nil {
+		return errors.Wrap(err, "read hot cache dir")
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		if fis[i].ModTime().Equal(fis[j].ModTime()) {
+			return fis[i].Name() < fis[j].Name()
+		}
+		return fis[i].ModTime().Before(fis[j].ModTime())
+	})
+	for _, fi := range fis {
+		if id, ok := IsBlockDir(fi.Name()); ok {
+			f.touchHotCachedMeta(id)
+		}
+	}
+	return nil
+}
+
+// touchHotCachedMeta marks the meta of the block in the hot tier of the disk cache as accessed and demotes the least
+// recently accessed metas to the cold tier if needed.
+func (f *BaseFetcher) touchHotCachedMeta(id ulid.ULID) {
+	if f.coldCache == nil {
+		return
+	}
+	for _, demoted := range f.coldCache.touch(id) {
+		f.moveCachedMeta(filepath.Join(f.cacheDir, demoted.String()), filepath.Join(f.coldCache.dir, demoted.String()))
+	}
+}
+
+// touchCachedMetas marks the disk-cached metas of the synced view as accessed, promoting them from the cold tier if
+// needed. Most metas are served from memory after the first synchronization, so this keeps the hot tier in line with
+// the blocks the fetcher returns. Blocks are touched in ULID order, so the newest ones stay hot if the view doesn't fit.
+func (f *BaseFetcher) touchCachedMetas(view map[ulid.ULID]*metadata.Meta) {
+	if f.coldCache == nil {
+		return
+	}
+	ids := make([]ulid.ULID, 0, len(view))
+	for id := range view {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Compare(ids[j]) < 0 })
+
+	f.coldCache.viewMtx.Lock()
+	defer f.coldCache.viewMtx.Unlock()
+
+	for _, id := range ids {
+		if !f.coldCache.isHot(id) {
+			coldBlockDir := filepath.Join(f.coldCache.dir, id.String())
+			if _, err := os.Stat(coldBlockDir); err != nil {
+				// Not cached on disk, nothing to promote.
+				continue
+			}
+			f.moveCachedMeta(coldBlockDir, filepath.Join(f.cacheDir, id.String()))
+		}
+		f.touchHotCachedMeta(id)
+	}
+}
+
+// loadColdCachedMeta loads the meta of the block from the cold tier of the disk cache, promoting it to the hot tier.
+func (f *BaseFetcher) loadColdCachedMeta(id ulid.ULID) (*metadata.Meta, bool) {
+	if f.coldCache == nil {
+		return nil, false
+	}
+	coldBlockDir := filepath.Join(f.coldCache.dir, id.String())
+	m, err := f.readCachedMeta(coldBlockDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			f.warnBestEffort("best effort read of the cold tier meta.json failed; removing cached block dir", "dir", coldBlockDir, "err", err)
+			if err := os.RemoveAll(coldBlockDir); err != nil {
+				f.warnBestEffort("best effort remove of cached dir failed; ignoring", "dir", coldBlockDir, "err", err)
+			}
+		}
+		return nil, false
+	}
+
+	f.moveCachedMeta(coldBlockDir, filepath.Join(f.cacheDir, id.String()))
+	f.touchHotCachedMeta(id)
+	return m, true
+}
+
+// moveCachedMeta moves disk-cached meta between cache tiers. Tiers are likely on different filesystems, so the meta is
+// rewritten instead of renamed.
+func (f *BaseFetcher) moveCachedMeta(src, dst string) {
+	m, err := f.readCachedMeta(src)
+	if err != nil {
+		f.warnBestEffort("best effort read of the cached meta.json to move failed; removing cached block dir", "dir", src, "err", err)
+	} else {
+		f.cacheOnDisk(dst, m)
+	}
+	if err := os.RemoveAll(src); err != nil {
+		f.warnBestEffort("best effort remove of cached dir failed; ignoring", "dir", src, "err", err)
+	}
+}
+
+// cleanUpCacheDir removes disk-cached metas of blocks that are not loaded anymore.
+func (f *BaseFetcher) cleanUpCacheDir(metas map[ulid.ULID]*metadata.Meta) {
+	f.cleanUpDir(f.cacheDir, metas)
+	if f.coldCache != nil {
+		f.cleanUpDir(f.coldCache.dir, metas)
+	}
+}
+
+func (f *BaseFetcher) cleanUpDir(dir string, metas map[ulid.ULID]*metadata.Meta) {
+	fis, err := ioutil.ReadDir(dir)
+	names := make([]string, 0, len(fis))
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	if err != nil {
+		f.warnBestEffort("best effort remove of not needed cached dirs failed; ignoring", "err", err)
+		return
+	}
+
+	for _, n := range names {
+		id, ok := IsBlockDir(n)
+		if !ok {
+			continue
+		}
+
+		if _, ok := metas[id]; ok {
+			continue
+		}
+
+		cachedBlockDir := filepath.Join(dir, id.String())
+		if f.coldCache != nil {
+			f.coldCache.forget(id)
+		}
+
+		// No such block loaded, remove the local dir.
+		if err := os.RemoveAll(cachedBlockDir); err != nil {
+			f.warnBestEffort("best effort remove of not needed cached dir failed; ignoring", "dir", cachedBlockDir, "err", err)
+		}
+	}
+}
+
+func (f *BaseFetcher) observeSyncDuration(ctx context.Context, h prometheus.Histogram, duration time.Duration) {
+	if f.exemplars && duration >= f.exemplarThreshold {
+		if traceID, ok := tracing.GetTraceIDFromContext(ctx); ok {
+			if eo, ok := h.(prometheus.ExemplarObserver); ok {
+				eo.ObserveWithExemplar(duration.Seconds(), prometheus.Labels{"traceID": traceID})
+				return
+			}
+		}
+	}
+	h.Observe(duration.Seconds())
+}
+
+func (f *BaseFetcher) fetch(ctx context.Context, metrics *FetcherMetrics, filters []MetadataFilter, modifiers []MetadataModifier) (view map[ulid.ULID]*metadata.Meta, _ map[ulid.ULID]error, _ []FilterStat, err error) {
+	start := time.Now()
+	defer func() {
+		f.observeSyncDuration(ctx, metrics.SyncDuration, time.Since(start))
+		if err != nil {
+			metrics.SyncFailures.Inc()
+		}
+	}()
+	metrics.Syncs.Inc()
+	metrics.ResetTx()
+
+	if f.fetchTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, f.fetchTimeout, errFetchTimedOut)
+		defer cancel()
+		defer func() {
+			if err != nil && fetchTimedOut(ctx) {
+				if view != nil {
+					err = errors.Wrapf(err, "incomplete view: fetch timed out after %v", f.fetchTimeout)
+					return
+				}
+				err = errors.Wrapf(err, "fetch timed out after %v", f.fetchTimeout)
+			}
+		}()
+	}
+
+	// Run this in thread safe run group.
+	// TODO(bwplotka): Consider custom singleflight with ttl.
+	v, err := f.g.Do("", func() (i interface{}, err error) {
+		// NOTE: First go routine context will go through.
+		return f.fetchMetadata(ctx)
+	})
+	if err != nil {
+		if resp, ok := v.(response); ok {
+			// Fetch timed out, or was canceled and partial results on cancel are enabled. Filters and modifiers can't run
+			// with canceled context.
+			metas := make(map[ulid.ULID]*metadata.Meta, len(resp.metas))
+			for id, m := range resp.metas {
+				metas[id] = m
+			}
+			if fetchTimedOut(ctx) {
+				// Wrapped as incomplete view on return.
+				return metas, resp.partial, nil, err
+			}
+			return metas, resp.partial, nil, errors.Wrap(err, "incomplete view: fetch canceled")
+		}
+		return nil, nil, nil, err
+	}
+	resp := v.(response)
+
+	// Copy as same response might be reused by different goroutines.
+	metas := make(map[ulid.ULID]*metadata.Meta, len(resp.metas))
+	for id, m := range resp.metas {
+		metas[id] = m
+	}
+
+	metrics.Synced.WithLabelValues(FailedMeta).Set(float64(len(resp.metaErrs)))
+	metrics.Synced.WithLabelValues(NoMeta).Set(resp.noMetas)
+	metrics.Synced.WithLabelValues(CorruptedMeta).Set(resp.corruptedMetas)
+	metrics.Synced.WithLabelValues(InvalidMeta).Set(resp.invalidMetas)
+	metrics.Synced.WithLabelValues(ClockSkewedMeta).Set(resp.clockSkewedMetas)
+	metrics.Synced.WithLabelValues(incompatibleVersionMeta).Set(resp.incompatibleVersionMetas)
+	metrics.Synced.WithLabelValues(memoryLimitExceededMeta).Set(resp.memLimitedMetas)
+	metrics.PartialRatio.Set(PartialRatio(resp.metas, resp.partial))
 
 	for _, filter := range filters {
-		// NOTE: filter can update synced metric accordingly to the reason of the exclude.
-		if err := filter.Filter(ctx, metas, metrics.Synced); err != nil {
-			return nil, nil, errors.Wrap(err, "filter metas")
+		if pf, ok := filter.(PartialAwareMetadataFilter); ok {
+			pf.SetPartial(resp.partial)
+		}
+	}
+	filterStats, err := f.filter(ctx, filters, metas, metrics.Synced)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "filter metas")
+	}
+	f.touchCachedMetas(metas)
+	if len(filterStats) > 0 {
+		kvs := []interface{}{"msg", "filtered block metadata"}
+		for _, s := range filterStats {
+			kvs = append(kvs, s.Filter, fmt.Sprintf("entered=%d dropped=%d", s.Entered, s.Dropped))
+		}
+		level.Debug(f.logger).Log(kvs...)
+	}
+
+	if len(modifiers) > 0 {
+		// Modifiers are destructive, so let them work on copies to keep cached metas pristine.
+		metas = copyMetas(metas)
+	}
+	if err := modify(ctx, modifiers, metas, metrics.Modified); err != nil {
+		return nil, nil, nil, err
+	}
+
+	metrics.Synced.WithLabelValues(LoadedMeta).Set(float64(len(metas)))
+	metrics.Submit()
+
+	if resp.incompleteView() {
+		errs := append(errutil.MultiError{}, resp.metaErrs...)
+		errs = append(errs, resp.partialErrs...)
+		return metas, resp.partial, filterStats, errors.Wrap(errs.Err(), "incomplete view")
+	}
+
+	level.Info(f.logger).Log("msg", "successfully synchronized block metadata", "duration", time.Since(start).String(), "cached", len(f.cached), "returned", len(metas), "partial", len(resp.partial))
+	return metas, resp.partial, filterStats, nil
+}
+
+// ValidateFilters returns an error if given filters are ordered in a known bad way, which would silently give wrong results.
+// DeduplicateFilter has to be after ConsistencyDelayMetaFilter and IgnoreDeletionMarkFilter, otherwise blocks could be dropped
+// as duplicates of blocks that are filtered out later. MaxBlocksMetaFilter has to be the last filter, otherwise the limit is
+// applied to blocks that are filtered out later. Modifiers always run after all filters, so they can't be misordered against filters.
+func ValidateFilters(filters []MetadataFilter) error {
+	dedup, maxBlocks := -1, -1
+	for i, filter := range filters {
+		if maxBlocks >= 0 {
+			return errors.Errorf("filter %d (%T) is after MaxBlocksMetaFilter (%d); MaxBlocksMetaFilter has to be the last filter", i, filter, maxBlocks)
+		}
+
+		switch filter.(type) {
+		case *DeduplicateFilter:
+			dedup = i
+		case *MaxBlocksMetaFilter:
+			maxBlocks = i
+		case *ConsistencyDelayMetaFilter, *IgnoreDeletionMarkFilter:
+			if dedup >= 0 {
+				return errors.Errorf("filter %d (%T) is after DeduplicateFilter (%d); DeduplicateFilter has to be after it", i, filter, dedup)
+			}
 		}
 	}
+	return nil
+}
 
+func modify(ctx context.Context, modifiers []MetadataModifier, metas map[ulid.ULID]*metadata.Meta, modified *extprom.TxGaugeVec) error {
 	for _, m := range modifiers {
 		// NOTE: modifier can update modified metric accordingly to the reason of the modification.
-		if err := m.Modify(ctx, metas, metrics.Modified); err != nil {
-			return nil, nil, errors.Wrap(err, "modify metas")
+		if err := m.Modify(ctx, metas, modified); err != nil {
+			return errors.Wrap(err, "modify metas")
 		}
 	}
+	return nil
+}
 
-	metrics.Synced.WithLabelValues(LoadedMeta).Set(float64(len(metas)))
-	metrics.Submit()
+// copyMetas returns copies of given metas that can be safely modified without affecting the originals.
+func copyMetas(metas map[ulid.ULID]*metadata.Meta) map[ulid.ULID]*metadata.Meta {
+	cp := make(map[ulid.ULID]*metadata.Meta, len(metas))
+	for id, m := range metas {
+		mcp := *m
+		mcp.Thanos.Labels = make(map[string]string, len(m.Thanos.Labels))
+		for k, v := range m.Thanos.Labels {
+			mcp.Thanos.Labels[k] = v
+		}
+		cp[id] = &mcp
+	}
+	return cp
+}
+
+// FilterStat is the number of blocks which entered and were dropped by the filter during a single Fetch.
+type FilterStat struct {
+	// Filter is the type of the filter, e.g. *block.DeduplicateFilter.
+	Filter  string
+	Entered int
+	Dropped int
+}
+
+// filter applies given filters in order. If concurrent filters are enabled, consecutive independent filters are evaluated concurrently.
+func (f *BaseFetcher) filter(ctx context.Context, filters []MetadataFilter, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) ([]FilterStat, error) {
+	stats := make([]FilterStat, 0, len(filters))
+	for i := 0; i < len(filters); {
+		j := i
+		for f.concurrentFilters && j < len(filters) {
+			if _, ok := filters[j].(IndependentMetadataFilter); !ok {
+				break
+			}
+			j++
+		}
+
+		if j-i < 2 {
+			entered := len(metas)
+			// NOTE: filter can update synced metric accordingly to the reason of the exclude.
+			if err := filters[i].Filter(ctx, metas, synced); err != nil {
+				return nil, err
+			}
+			stats = append(stats, FilterStat{Filter: fmt.Sprintf("%T", filters[i]), Entered: entered, Dropped: entered - len(metas)})
+			i++
+			continue
+		}
+
+		independent := make([]IndependentMetadataFilter, 0, j-i)
+		for _, filter := range filters[i:j] {
+			independent = append(independent, filter.(IndependentMetadataFilter))
+		}
+		// Account drops as if filters were run sequentially.
+		entered := len(metas)
+		for k, dropped := range filterConcurrently(independent, metas, synced) {
+			stats = append(stats, FilterStat{Filter: fmt.Sprintf("%T", filters[i+k]), Entered: entered, Dropped: dropped})
+			entered -= dropped
+		}
+		i = j
+	}
+	return stats, nil
+}
+
+// filterConcurrently evaluates independent filters concurrently over the same read-only metas, and then applies
+// their exclusions in the filters order, so the result and synced metric are the same as if filters were applied sequentially.
+func filterConcurrently(filters []IndependentMetadataFilter, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) (dropped []int) {
+	type exclusion struct {
+		id    ulid.ULID
+		state string
+	}
+
+	var (
+		wg         sync.WaitGroup
+		exclusions = make([][]exclusion, len(filters))
+	)
+	for i, filter := range filters {
+		wg.Add(1)
+		go func(i int, filter IndependentMetadataFilter) {
+			defer wg.Done()
+
+			for id, m := range metas {
+				if state, excluded := filter.Excludes(id, m); excluded {
+					exclusions[i] = append(exclusions[i], exclusion{id: id, state: state})
+				}
+			}
+		}(i, filter)
+	}
+	wg.Wait()
+
+	dropped = make([]int, len(filters))
+	for i, excl := range exclusions {
+		for _, e := range excl {
+			if _, ok := metas[e.id]; !ok {
+				// Already filtered out by the previous filter.
+				continue
+			}
+			synced.WithLabelValues(e.state).Inc()
+			delete(metas, e.id)
+			dropped[i]++
+		}
+	}
+	return dropped
+}
+
+type MetaFetcher struct {
+	wrapped *BaseFetcher
+	metrics *FetcherMetrics
+
+	filters   []MetadataFilter
+	modifiers []MetadataModifier
+
+	listener func([]metadata.Meta, error)
+
+	events chan<- BlockEvent
+
+	mtx         sync.Mutex
+	eventsView  map[ulid.ULID]struct{}
+	view        []ulid.ULID
+	lastMetas   map[ulid.ULID]*metadata.Meta
+	lastPartial map[ulid.ULID]error
+	filterStats []FilterStat
+
+	logger log.Logger
+}
+
+// Fetch returns all block metas as well as partial blocks (blocks without or with corrupted meta file) from the bucket.
+// It's caller responsibility to not change the returned metadata files. Maps can be modified.
+//
+// Returned error indicates a failure in fetching metadata. Returned meta can be assumed as correct, with some blocks missing.
+func (f *MetaFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error) {
+	metas, partial, filterStats, err := f.wrapped.fetch(ctx, f.metrics, f.filters, f.modifiers)
+
+	view := make([]ulid.ULID, 0, len(metas))
+	lastMetas := make(map[ulid.ULID]*metadata.Meta, len(metas))
+	for id, m := range metas {
+		view = append(view, id)
+		lastMetas[id] = m
+	}
+	lastPartial := make(map[ulid.ULID]error, len(partial))
+	for id, err := range partial {
+		lastPartial[id] = err
+	}
+	f.mtx.Lock()
+	f.view = view
+	f.lastMetas = lastMetas
+	f.lastPartial = lastPartial
+	f.filterStats = filterStats
+	f.mtx.Unlock()
+
+	f.notify(metas, err)
+	if err == nil {
+		f.emitEvents(metas)
+	}
+	return metas, partial, err
+}
+
+// LastTotals returns the storage footprint of blocks returned by the last Fetch. It's computed on every call.
+func (f *MetaFetcher) LastTotals() Totals {
+	f.mtx.Lock()
+	metas := f.lastMetas
+	f.mtx.Unlock()
+
+	return ComputeTotals(metas)
+}
+
+// SyncedValue returns the number of blocks in the given synced state (e.g. LoadedMeta) after the last Fetch, as exposed by
+// the synced metric. Unlike the metric itself, it doesn't need a registry, which is handy in tests.
+func (f *MetaFetcher) SyncedValue(state string) float64 {
+	return f.metrics.Synced.Value(state)
+}
+
+// FilterStats returns the number of blocks which entered and were dropped by each filter, in order, during the last Fetch.
+// It's empty if the last Fetch failed before filtering.
+func (f *MetaFetcher) FilterStats() []FilterStat {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return f.filterStats
+}
+
+// FetchViewVersion is the version of the JSON document written by MetaFetcher.MarshalView. It's increased on every
+// incompatible change of the document.
+const FetchViewVersion = 1
+
+// FetchView is the JSON representation of blocks returned by a Fetch, decoupled from internal types.
+type FetchView struct {
+	Version int                `json:"version"`
+	Blocks  []FetchViewBlock   `json:"blocks"`
+	Partial []FetchViewPartial `json:"partial"`
+}
+
+// FetchViewBlock describes a block returned by a Fetch.
+type FetchViewBlock struct {
+	ULID            ulid.ULID         `json:"ulid"`
+	Labels          map[string]string `json:"labels"`
+	MinTime         int64             `json:"minTime"`
+	MaxTime         int64             `json:"maxTime"`
+	Resolution      int64             `json:"resolution"`
+	CompactionLevel int               `json:"compactionLevel"`
+}
+
+// FetchViewPartial describes a partial block (without or with corrupted meta file) found by a Fetch.
+type FetchViewPartial struct {
+	ULID   ulid.ULID `json:"ulid"`
+	Reason string    `json:"reason"`
+}
+
+// MarshalView writes the JSON representation of the blocks returned by the last Fetch to w, see FetchView. Blocks and
+// partial blocks are sorted by ULID, so the same view always produces the same document.
+func (f *MetaFetcher) MarshalView(w io.Writer) error {
+	f.mtx.Lock()
+	metas, partial := f.lastMetas, f.lastPartial
+	f.mtx.Unlock()
+	if metas == nil {
+		return errors.New("no blocks fetched yet")
+	}
+
+	v := FetchView{
+		Version: FetchViewVersion,
+		Blocks:  make([]FetchViewBlock, 0, len(metas)),
+		Partial: make([]FetchViewPartial, 0, len(partial)),
+	}
+	for id, m := range metas {
+		lset := make(map[string]string, len(m.Thanos.Labels))
+		for k, val := range m.Thanos.Labels {
+			lset[k] = val
+		}
+		v.Blocks = append(v.Blocks, FetchViewBlock{
+			ULID:            id,
+			Labels:          lset,
+			MinTime:         m.MinTime,
+			MaxTime:         m.MaxTime,
+			Resolution:      m.Thanos.Downsample.Resolution,
+			CompactionLevel: m.Compaction.Level,
+		})
+	}
+	for id, err := range partial {
+		v.Partial = append(v.Partial, FetchViewPartial{ULID: id, Reason: err.Error()})
+	}
+	sort.Slice(v.Blocks, func(i, j int) bool { return v.Blocks[i].ULID.Compare(v.Blocks[j].ULID) < 0 })
+	sort.Slice(v.Partial, func(i, j int) bool { return v.Partial[i].ULID.Compare(v.Partial[j].ULID) < 0 })
+
+	return errors.Wrap(json.NewEncoder(w).Encode(v), "encode fetch view")
+}
+
+// SlowestBlocks returns up to n blocks which metadata took the longest to load during the last synchronization, the
+// slowest first. Only as many blocks as configured by WithSlowestBlocksTracking are tracked; it's empty if not enabled.
+// Synchronization is shared by all MetaFetchers created from the same BaseFetcher.
+func (f *MetaFetcher) SlowestBlocks(n int) []BlockTiming {
+	f.wrapped.slowestMtx.Lock()
+	defer f.wrapped.slowestMtx.Unlock()
+
+	if n > len(f.wrapped.slowest) {
+		n = len(f.wrapped.slowest)
+	}
+	if n < 0 {
+		n = 0
+	}
+	res := make([]BlockTiming, n)
+	copy(res, f.wrapped.slowest[:n])
+	return res
+}
+
+// ReapplyModifiers re-runs modifiers over the blocks returned by the last Fetch, without listing the bucket again.
+// Modifiers are applied to the cached metas, which are never modified, so it's safe to use it after changing modifiers
+// configuration, e.g. replica labels (see ReplicaLabelRemover.SetReplicaLabels). Blocks evicted from cache by fetches from other MetaFetchers of the same BaseFetcher are skipped.
+func (f *MetaFetcher) ReapplyModifiers(ctx context.Context) (map[ulid.ULID]*metadata.Meta, error) {
+	f.mtx.Lock()
+	view := f.view
+	f.mtx.Unlock()
+	if view == nil {
+		return nil, errors.New("no blocks fetched yet")
+	}
+
+	pristine := make(map[ulid.ULID]*metadata.Meta, len(view))
+	f.wrapped.cachedMtx.RLock()
+	for _, id := range view {
+		if m, ok := f.wrapped.cached[id]; ok {
+			pristine[id] = m
+		}
+	}
+	f.wrapped.cachedMtx.RUnlock()
+
+	metas := copyMetas(pristine)
+	f.metrics.Modified.ResetTx()
+	if err := modify(ctx, f.modifiers, metas, f.metrics.Modified); err != nil {
+		return nil, err
+	}
+	f.metrics.Modified.Submit()
+
+	f.notify(metas, nil)
+	return metas, nil
+}
+
+func (f *MetaFetcher) notify(metas map[ulid.ULID]*metadata.Meta, err error) {
+	if f.listener == nil {
+		return
+	}
+	blocks := make([]metadata.Meta, 0, len(metas))
+	for _, meta := range metas {
+		blocks = append(blocks, *meta)
+	}
+	f.listener(blocks, err)
+}
+
+// UpdateOnChange allows to add listener that will be update on every change.
+func (f *MetaFetcher) UpdateOnChange(listener func([]metadata.Meta, error)) {
+	f.listener = listener
+}
+
+// BlockEventType is the type of BlockEvent.
+type BlockEventType int
+
+const (
+	// BlockAdded means the block appeared in the fetched view.
+	BlockAdded BlockEventType = iota
+	// BlockRemoved means the block disappeared from the fetched view.
+	BlockRemoved
+)
+
+func (t BlockEventType) String() string {
+	switch t {
+	case BlockAdded:
+		return "added"
+	case BlockRemoved:
+		return "removed"
+	}
+	return fmt.Sprintf("BlockEventType(%d)", int(t))
+}
+
+// BlockEvent is a change of the fetched view between two consecutive successful fetches.
+type BlockEvent struct {
+	Type BlockEventType
+	ID   ulid.ULID
+}
+
+// EmitEvents makes Fetch send events about blocks added and removed since the previous successful Fetch to ch. On the first
+// successful Fetch, all returned blocks are added. Sending never blocks Fetch: events which don't fit into ch are dropped
+// and accounted in the dropped events metric, so ch should be buffered. Failed fetches don't emit any events.
+func (f *MetaFetcher) EmitEvents(ch chan<- BlockEvent) {
+	f.events = ch
+}
+
+func (f *MetaFetcher) emitEvents(metas map[ulid.ULID]*metadata.Meta) {
+	if f.events == nil {
+		return
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	var events []BlockEvent
+	for id := range metas {
+		if _, ok := f.eventsView[id]; !ok {
+			events = append(events, BlockEvent{Type: BlockAdded, ID: id})
+		}
+	}
+	for id := range f.eventsView {
+		if _, ok := metas[id]; !ok {
+			events = append(events, BlockEvent{Type: BlockRemoved, ID: id})
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID.Compare(events[j].ID) < 0 })
+
+	f.eventsView = make(map[ulid.ULID]struct{}, len(metas))
+	for id := range metas {
+		f.eventsView[id] = struct{}{}
+	}
+
+	for _, e := range events {
+		select {
+		case f.events <- e:
+		default:
+			f.metrics.DroppedEvents.Inc()
+		}
+	}
+}
+
+// maxPeriodicFetchBackoff is the maximum multiple of the interval RunPeriodic waits after consecutive failed fetches.
+const maxPeriodicFetchBackoff = 16
+
+// RunPeriodic calls f.Fetch every interval until ctx is done, passing each result to onResult. Each wait is extended by
+// a random duration up to jitter, including the wait before the first fetch, so replicas started at the same time don't
+// hit the bucket all at once. After consecutive failures the interval doubles up to 16 times the interval, and it is
+// reset by the first successful fetch. Results of fetches interrupted by ctx being done are not passed to onResult.
+func RunPeriodic(ctx context.Context, f MetadataFetcher, interval, jitter time.Duration, onResult func(metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error)) {
+	b := backoff.Backoff{Min: interval, Max: maxPeriodicFetchBackoff * interval, Factor: 2}
+
+	var (
+		failures int
+		timer    = time.NewTimer(randomDuration(jitter))
+	)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		metas, partial, err := f.Fetch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		onResult(metas, partial, err)
 
-	if len(resp.metaErrs) > 0 {
-		return metas, resp.partial, errors.Wrap(resp.metaErrs.Err(), "incomplete view")
+		if err != nil {
+			failures++
+		} else {
+			failures = 0
+		}
+		timer.Reset(b.ForAttempt(float64(failures)) + randomDuration(jitter))
 	}
+}
 
-	level.Info(f.logger).Log("msg", "successfully synchronized block metadata", "duration", time.Since(start).String(), "cached", len(f.cached), "returned", len(metas), "partial", len(resp.partial))
-	return metas, resp.partial, nil
+// randomDuration returns a random duration in [0, max).
+func randomDuration(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
 }
 
-type MetaFetcher struct {
-	wrapped *BaseFetcher
-	metrics *FetcherMetrics
+var _ MetadataFetcher = &MergingFetcher{}
 
-	filters   []MetadataFilter
-	modifiers []MetadataModifier
+// MergingFetcher is a MetadataFetcher that fetches from multiple fetchers concurrently (e.g. one per bucket) and merges their views.
+// Error from any of the fetchers, as well as the same block found by more than one fetcher, makes the merged view incomplete.
+type MergingFetcher struct {
+	fetchers []MetadataFetcher
 
 	listener func([]metadata.Meta, error)
+}
 
-	logger log.Logger
+// NewMergingFetcher creates MergingFetcher.
+func NewMergingFetcher(fetchers ...MetadataFetcher) *MergingFetcher {
+	return &MergingFetcher{fetchers: fetchers}
 }
 
-// Fetch returns all block metas as well as partial blocks (blocks without or with corrupted meta file) from the bucket.
-// It's caller responsibility to not change the returned metadata files. Maps can be modified.
-//
-// Returned error indicates a failure in fetching metadata. Returned meta can be assumed as correct, with some blocks missing.
-func (f *MetaFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error) {
-	metas, partial, err = f.wrapped.fetch(ctx, f.metrics, f.filters, f.modifiers)
+// Fetch returns merged block metas as well as partial blocks from all fetchers.
+// Returned error indicates that at least one fetcher failed or blocks collided. Returned meta can be assumed as correct, with some blocks missing.
+func (f *MergingFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.Meta, partial map[ulid.ULID]error, err error) {
+	type result struct {
+		metas   map[ulid.ULID]*metadata.Meta
+		partial map[ulid.ULID]error
+		err     error
+	}
+
+	var (
+		wg      sync.WaitGroup
+		results = make([]result, len(f.fetchers))
+	)
+	for i, fetcher := range f.fetchers {
+		wg.Add(1)
+		go func(i int, fetcher MetadataFetcher) {
+			defer wg.Done()
+
+			var r result
+			r.metas, r.partial, r.err = fetcher.Fetch(ctx)
+			results[i] = r
+		}(i, fetcher)
+	}
+	wg.Wait()
+
+	var errs errutil.MultiError
+	metas = map[ulid.ULID]*metadata.Meta{}
+	partial = map[ulid.ULID]error{}
+	for i, r := range results {
+		if r.err != nil {
+			errs.Add(errors.Wrapf(r.err, "fetcher %d", i))
+		}
+		for id, m := range r.metas {
+			if _, ok := metas[id]; ok {
+				errs.Add(errors.Errorf("block %s returned by more than one fetcher", id))
+				continue
+			}
+			metas[id] = m
+		}
+		for id, perr := range r.partial {
+			partial[id] = perr
+		}
+	}
+	if len(errs) > 0 {
+		err = errors.Wrap(errs.Err(), "incomplete view")
+	}
+
 	if f.listener != nil {
 		blocks := make([]metadata.Meta, 0, len(metas))
 		for _, meta := range metas {
@@ -506,11 +2332,11 @@ func (f *MetaFetcher) Fetch(ctx context.Context) (metas map[ulid.ULID]*metadata.
 }
 
 // UpdateOnChange allows to add listener that will be update on every change.
-func (f *MetaFetcher) UpdateOnChange(listener func([]metadata.Meta, error)) {
+func (f *MergingFetcher) UpdateOnChange(listener func([]metadata.Meta, error)) {
 	f.listener = listener
 }
 
-var _ MetadataFilter = &TimePartitionMetaFilter{}
+var _ IndependentMetadataFilter = &TimePartitionMetaFilter{}
 
 // TimePartitionMetaFilter is a BaseFetcher filter that filters out blocks that are outside of specified time range.
 // Not go-routine safe.
@@ -525,17 +2351,19 @@ func NewTimePartitionMetaFilter(MinTime, MaxTime model.TimeOrDurationValue) *Tim
 
 // Filter filters out blocks that are outside of specified time range.
 func (f *TimePartitionMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
-	for id, m := range metas {
-		if m.MaxTime >= f.minTime.PrometheusTimestamp() && m.MinTime <= f.maxTime.PrometheusTimestamp() {
-			continue
-		}
-		synced.WithLabelValues(timeExcludedMeta).Inc()
-		delete(metas, id)
-	}
+	filterIndependent(f, metas, synced)
 	return nil
 }
 
-var _ MetadataFilter = &LabelShardedMetaFilter{}
+// Excludes returns true if block is outside of specified time range.
+func (f *TimePartitionMetaFilter) Excludes(_ ulid.ULID, m *metadata.Meta) (string, bool) {
+	if m.MaxTime >= f.minTime.PrometheusTimestamp() && m.MinTime <= f.maxTime.PrometheusTimestamp() {
+		return "", false
+	}
+	return timeExcludedMeta, true
+}
+
+var _ IndependentMetadataFilter = &LabelShardedMetaFilter{}
 
 // LabelShardedMetaFilter represents struct that allows sharding.
 // Not go-routine safe.
@@ -553,22 +2381,90 @@ const BlockIDLabel = "__block_id"
 
 // Filter filters out blocks that have no labels after relabelling of each block external (Thanos) labels.
 func (f *LabelShardedMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
-	var lbls labels.Labels
-	for id, m := range metas {
-		lbls = lbls[:0]
-		lbls = append(lbls, labels.Label{Name: BlockIDLabel, Value: id.String()})
-		for k, v := range m.Thanos.Labels {
-			lbls = append(lbls, labels.Label{Name: k, Value: v})
-		}
+	filterIndependent(f, metas, synced)
+	return nil
+}
 
-		if processedLabels := relabel.Process(lbls, f.relabelConfig...); len(processedLabels) == 0 {
-			synced.WithLabelValues(labelExcludedMeta).Inc()
-			delete(metas, id)
+// Excludes returns true if block has no labels after relabelling of its external (Thanos) labels.
+func (f *LabelShardedMetaFilter) Excludes(id ulid.ULID, m *metadata.Meta) (string, bool) {
+	lbls := make(labels.Labels, 0, len(m.Thanos.Labels)+1)
+	lbls = append(lbls, labels.Label{Name: BlockIDLabel, Value: id.String()})
+	for k, v := range m.Thanos.Labels {
+		lbls = append(lbls, labels.Label{Name: k, Value: v})
+	}
+
+	if processedLabels := relabel.Process(lbls, f.relabelConfig...); len(processedLabels) == 0 {
+		return labelExcludedMeta, true
+	}
+	return "", false
+}
+
+var _ IndependentMetadataFilter = &LabelMatchMetaFilter{}
+
+// LabelMatchMetaFilter is a BaseFetcher filter that keeps only blocks which external (Thanos) labels match all
+// given matchers. It's a simpler alternative to LabelShardedMetaFilter for scoping by label values.
+// Not go-routine safe.
+type LabelMatchMetaFilter struct {
+	matchers []*labels.Matcher
+}
+
+// NewLabelMatchMetaFilter creates LabelMatchMetaFilter.
+func NewLabelMatchMetaFilter(matchers []*labels.Matcher) *LabelMatchMetaFilter {
+	return &LabelMatchMetaFilter{matchers: matchers}
+}
+
+// Filter filters out blocks which external labels don't match all matchers.
+func (f *LabelMatchMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	filterIndependent(f, metas, synced)
+	return nil
+}
+
+// Excludes returns true if block external labels don't match all matchers. Missing label has empty value, as in
+// PromQL selectors.
+func (f *LabelMatchMetaFilter) Excludes(_ ulid.ULID, m *metadata.Meta) (string, bool) {
+	for _, matcher := range f.matchers {
+		if !matcher.Matches(m.Thanos.Labels[matcher.Name]) {
+			return labelMismatchMeta, true
 		}
 	}
+	return "", false
+}
+
+var _ IndependentMetadataFilter = &MaxAgeMetaFilter{}
+
+// MaxAgeMetaFilter is a BaseFetcher filter that filters out blocks which MaxTime is older than the given age, regardless
+// of any retention policy. Unlike TimePartitionMetaFilter, the age is always relative to the current wall clock time.
+// Not go-routine safe.
+type MaxAgeMetaFilter struct {
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// NewMaxAgeMetaFilter creates MaxAgeMetaFilter. Zero maxAge disables filtering.
+func NewMaxAgeMetaFilter(maxAge time.Duration) *MaxAgeMetaFilter {
+	return &MaxAgeMetaFilter{maxAge: maxAge, now: time.Now}
+}
+
+// Filter filters out blocks which data is older than max age.
+func (f *MaxAgeMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	if f.maxAge <= 0 {
+		return nil
+	}
+	filterIndependent(f, metas, synced)
 	return nil
 }
 
+// Excludes returns true if block MaxTime is older than max age.
+func (f *MaxAgeMetaFilter) Excludes(_ ulid.ULID, m *metadata.Meta) (string, bool) {
+	if f.maxAge <= 0 {
+		return "", false
+	}
+	if m.MaxTime < timestamp.FromTime(f.now().Add(-f.maxAge)) {
+		return tooOldMeta, true
+	}
+	return "", false
+}
+
 var _ MetadataFilter = &DeduplicateFilter{}
 
 // DeduplicateFilter is a BaseFetcher filter that filters out older blocks that have exactly the same data.
@@ -690,13 +2586,107 @@ func contains(s1 []ulid.ULID, s2 []ulid.ULID) bool {
 	return true
 }
 
+var _ MetadataFilter = &OverlapDetector{}
+
+// Overlap is a pair of blocks with the same external labels and resolution, which time ranges overlap.
+type Overlap struct {
+	// Group is the external labels and resolution both blocks share.
+	Group  string
+	First  ulid.ULID
+	Second ulid.ULID
+}
+
+// OverlapDetector is a BaseFetcher filter that reports overlapping blocks of the same group, without filtering out any block.
+// Such blocks, if not deduplicated by DeduplicateFilter, indicate compaction or replication problems.
+type OverlapDetector struct {
+	logger            log.Logger
+	overlappingGroups prometheus.Gauge
+
+	mtx      sync.Mutex
+	overlaps []Overlap
+}
+
+// NewOverlapDetector creates OverlapDetector.
+func NewOverlapDetector(logger log.Logger, reg prometheus.Registerer) *OverlapDetector {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &OverlapDetector{
+		logger: logger,
+		overlappingGroups: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Subsystem: fetcherSubSys,
+			Name:      "overlapping_groups",
+			Help:      "Number of groups of blocks with the same external labels and resolution that have overlapping blocks.",
+		}),
+	}
+}
+
+// Filter detects overlapping blocks within each group. It does not modify metas.
+func (f *OverlapDetector) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, _ *extprom.TxGaugeVec) error {
+	groups := map[string][]*metadata.Meta{}
+	for _, m := range metas {
+		g := fmt.Sprintf("%s@%d", labels.FromMap(m.Thanos.Labels).String(), m.Thanos.Downsample.Resolution)
+		groups[g] = append(groups[g], m)
+	}
+
+	groupKeys := make([]string, 0, len(groups))
+	for g := range groups {
+		groupKeys = append(groupKeys, g)
+	}
+	sort.Strings(groupKeys)
+
+	var overlaps []Overlap
+	overlappingGroups := 0
+	for _, g := range groupKeys {
+		group := groups[g]
+		sort.Slice(group, func(i, j int) bool {
+			if group[i].MinTime == group[j].MinTime {
+				return group[i].ULID.Compare(group[j].ULID) < 0
+			}
+			return group[i].MinTime < group[j].MinTime
+		})
+
+		found := len(overlaps)
+		for i, m := range group {
+			// Blocks are sorted by MinTime, so only following blocks starting before this one ends can overlap with it.
+			for _, next := range group[i+1:] {
+				if next.MinTime >= m.MaxTime {
+					break
+				}
+				overlaps = append(overlaps, Overlap{Group: g, First: m.ULID, Second: next.ULID})
+			}
+		}
+		if len(overlaps) > found {
+			overlappingGroups++
+			level.Warn(f.logger).Log("msg", "found overlapping blocks", "group", g, "overlaps", len(overlaps)-found)
+		}
+	}
+
+	f.overlappingGroups.Set(float64(overlappingGroups))
+
+	f.mtx.Lock()
+	f.overlaps = overlaps
+	f.mtx.Unlock()
+	return nil
+}
+
+// Overlaps returns pairs of overlapping blocks found during the last Filter call, ordered by group and blocks MinTime.
+func (f *OverlapDetector) Overlaps() []Overlap {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return append([]Overlap(nil), f.overlaps...)
+}
+
 var _ MetadataModifier = &ReplicaLabelRemover{}
 
 // ReplicaLabelRemover is a BaseFetcher modifier modifies external labels of existing blocks, it removes given replica labels from the metadata of blocks that have it.
 type ReplicaLabelRemover struct {
 	logger log.Logger
 
+	mtx           sync.Mutex
 	replicaLabels []string
+	modifiedIDs   []ulid.ULID
 }
 
 // NewReplicaLabelRemover creates a ReplicaLabelRemover.
@@ -704,39 +2694,83 @@ func NewReplicaLabelRemover(logger log.Logger, replicaLabels []string) *ReplicaL
 	return &ReplicaLabelRemover{logger: logger, replicaLabels: replicaLabels}
 }
 
+// SetReplicaLabels changes replica labels removed by next modifications, e.g. on configuration reload. Use
+// MetaFetcher.ReapplyModifiers to apply them to already fetched blocks.
+func (r *ReplicaLabelRemover) SetReplicaLabels(replicaLabels []string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.replicaLabels = replicaLabels
+}
+
 // Modify modifies external labels of existing blocks, it removes given replica labels from the metadata of blocks that have it.
 func (r *ReplicaLabelRemover) Modify(_ context.Context, metas map[ulid.ULID]*metadata.Meta, modified *extprom.TxGaugeVec) error {
-	if len(r.replicaLabels) == 0 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.modifiedIDs = r.modifiedIDs[:0]
+	replicaLabels := r.replicaLabels
+	if len(replicaLabels) == 0 {
 		return nil
 	}
 
 	for u, meta := range metas {
 		l := meta.Thanos.Labels
-		for _, replicaLabel := range r.replicaLabels {
+		removed := false
+		for _, replicaLabel := range replicaLabels {
 			if _, exists := l[replicaLabel]; exists {
 				level.Debug(r.logger).Log("msg", "replica label removed", "label", replicaLabel)
 				delete(l, replicaLabel)
 				modified.WithLabelValues(replicaRemovedMeta).Inc()
+				removed = true
 			}
 		}
+		if removed {
+			r.modifiedIDs = append(r.modifiedIDs, u)
+		}
 		if len(l) == 0 {
-			level.Warn(r.logger).Log("msg", "block has no labels left, creating one", r.replicaLabels[0], "deduped")
-			l[r.replicaLabels[0]] = "deduped"
+			level.Warn(r.logger).Log("msg", "block has no labels left, creating one", replicaLabels[0], "deduped")
+			l[replicaLabels[0]] = "deduped"
 		}
 		metas[u].Thanos.Labels = l
 	}
+	sort.Slice(r.modifiedIDs, func(i, j int) bool {
+		return r.modifiedIDs[i].Compare(r.modifiedIDs[j]) < 0
+	})
 	return nil
 }
 
+// ModifiedIDs returns sorted slice of block ids which had replica labels removed by the last Modify call.
+func (r *ReplicaLabelRemover) ModifiedIDs() []ulid.ULID {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.modifiedIDs
+}
+
+var _ IndependentMetadataFilter = &ConsistencyDelayMetaFilter{}
+
 // ConsistencyDelayMetaFilter is a BaseFetcher filter that filters out blocks that are created before a specified consistency delay.
 // Not go-routine safe.
 type ConsistencyDelayMetaFilter struct {
 	logger           log.Logger
 	consistencyDelay time.Duration
+	sourceDelays     map[metadata.SourceType]time.Duration
+}
+
+// ConsistencyDelayOption configures optional behaviour of the ConsistencyDelayMetaFilter.
+type ConsistencyDelayOption func(f *ConsistencyDelayMetaFilter)
+
+// WithSourceConsistencyDelay sets the consistency delay for blocks uploaded by the given source, instead of the default one.
+// It also applies to sources that are otherwise never delayed (e.g. compactor).
+func WithSourceConsistencyDelay(source metadata.SourceType, delay time.Duration) ConsistencyDelayOption {
+	return func(f *ConsistencyDelayMetaFilter) {
+		f.sourceDelays[source] = delay
+	}
 }
 
 // NewConsistencyDelayMetaFilter creates ConsistencyDelayMetaFilter.
-func NewConsistencyDelayMetaFilter(logger log.Logger, consistencyDelay time.Duration, reg prometheus.Registerer) *ConsistencyDelayMetaFilter {
+func NewConsistencyDelayMetaFilter(logger log.Logger, consistencyDelay time.Duration, reg prometheus.Registerer, opts ...ConsistencyDelayOption) *ConsistencyDelayMetaFilter {
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
@@ -747,32 +2781,132 @@ func NewConsistencyDelayMetaFilter(logger log.Logger, consistencyDelay time.Dura
 		return consistencyDelay.Seconds()
 	})
 
-	return &ConsistencyDelayMetaFilter{
+	f := &ConsistencyDelayMetaFilter{
 		logger:           logger,
 		consistencyDelay: consistencyDelay,
+		sourceDelays:     map[metadata.SourceType]time.Duration{},
 	}
+	for _, o := range opts {
+		o(f)
+	}
+	return f
 }
 
 // Filter filters out blocks that filters blocks that have are created before a specified consistency delay.
 func (f *ConsistencyDelayMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
-	for id, meta := range metas {
-		// TODO(khyatisoneji): Remove the checks about Thanos Source
-		//  by implementing delete delay to fetch metas.
-		// TODO(bwplotka): Check consistency delay based on file upload / modification time instead of ULID.
-		if ulid.Now()-id.Time() < uint64(f.consistencyDelay/time.Millisecond) &&
-			meta.Thanos.Source != metadata.BucketRepairSource &&
-			meta.Thanos.Source != metadata.CompactorSource &&
-			meta.Thanos.Source != metadata.CompactorRepairSource {
-
-			level.Debug(f.logger).Log("msg", "block is too fresh for now", "block", id)
-			synced.WithLabelValues(tooFreshMeta).Inc()
-			delete(metas, id)
+	filterIndependent(f, metas, synced)
+	return nil
+}
+
+// Excludes returns true if block was created before a specified consistency delay.
+func (f *ConsistencyDelayMetaFilter) Excludes(id ulid.ULID, meta *metadata.Meta) (string, bool) {
+	// TODO(bwplotka): Check consistency delay based on file upload / modification time instead of ULID.
+	if ulid.Now()-id.Time() < uint64(f.delay(meta.Thanos.Source)/time.Millisecond) {
+		level.Debug(f.logger).Log("msg", "block is too fresh for now", "block", id)
+		return tooFreshMeta, true
+	}
+	return "", false
+}
+
+// Delay returns the configured consistency delay, the one exposed by the consistency_delay_seconds metric. Per source
+// delays may differ from it.
+func (f *ConsistencyDelayMetaFilter) Delay() time.Duration {
+	return f.consistencyDelay
+}
+
+// delay returns consistency delay for blocks uploaded by the given source.
+func (f *ConsistencyDelayMetaFilter) delay(source metadata.SourceType) time.Duration {
+	if d, ok := f.sourceDelays[source]; ok {
+		return d
+	}
+	// TODO(khyatisoneji): Remove the checks about Thanos Source
+	//  by implementing delete delay to fetch metas.
+	switch source {
+	case metadata.BucketRepairSource, metadata.CompactorSource, metadata.CompactorRepairSource:
+		return 0
+	}
+	return f.consistencyDelay
+}
+
+var _ SyncedStatesMetadataFilter = &PredicateMetaFilter{}
+
+// PredicateMetaFilter is a BaseFetcher filter that filters out blocks for which the given predicate returns false.
+// It allows ad-hoc filtering without defining a new filter type.
+// Not go-routine safe.
+type PredicateMetaFilter struct {
+	state string
+	keep  func(*metadata.Meta) bool
+}
+
+// NewPredicateMetaFilter creates PredicateMetaFilter. Filtered out blocks are accounted in the synced metric with the given state,
+// which MetaFetcher initializes along with the default ones.
+func NewPredicateMetaFilter(state string, keep func(*metadata.Meta) bool) *PredicateMetaFilter {
+	return &PredicateMetaFilter{state: state, keep: keep}
+}
+
+// SyncedStates returns the synced metric state of filtered out blocks.
+func (f *PredicateMetaFilter) SyncedStates() []string {
+	return []string{f.state}
+}
+
+// Filter filters out blocks for which the predicate returns false.
+func (f *PredicateMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	for id, m := range metas {
+		if f.keep(m) {
+			continue
 		}
+		synced.WithLabelValues(f.state).Inc()
+		delete(metas, id)
+	}
+	return nil
+}
+
+var _ MetadataFilter = &MaxBlocksMetaFilter{}
+
+// MaxBlocksMetaFilter is a BaseFetcher filter that keeps only the given number of the newest (by MinTime) blocks.
+// It is a safety valve protecting from a runaway number of blocks (e.g. millions of tiny blocks) overwhelming memory
+// at the cost of not loading older blocks, so it should be placed after all other filters.
+// Not go-routine safe.
+type MaxBlocksMetaFilter struct {
+	logger    log.Logger
+	maxBlocks int
+}
+
+// NewMaxBlocksMetaFilter creates MaxBlocksMetaFilter. Zero or negative maxBlocks means no limit.
+func NewMaxBlocksMetaFilter(logger log.Logger, maxBlocks int) *MaxBlocksMetaFilter {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	return &MaxBlocksMetaFilter{logger: logger, maxBlocks: maxBlocks}
+}
+
+// Filter filters out the oldest blocks exceeding the configured limit.
+func (f *MaxBlocksMetaFilter) Filter(_ context.Context, metas map[ulid.ULID]*metadata.Meta, synced *extprom.TxGaugeVec) error {
+	if f.maxBlocks <= 0 || len(metas) <= f.maxBlocks {
+		return nil
+	}
+
+	ids := make([]ulid.ULID, 0, len(metas))
+	for id := range metas {
+		ids = append(ids, id)
 	}
+	sort.Slice(ids, func(i, j int) bool {
+		if metas[ids[i]].MinTime == metas[ids[j]].MinTime {
+			return ids[i].Compare(ids[j]) > 0
+		}
+		return metas[ids[i]].MinTime > metas[ids[j]].MinTime
+	})
 
+	for _, id := range ids[f.maxBlocks:] {
+		synced.WithLabelValues(blockLimitExceededMeta).Inc()
+		delete(metas, id)
+	}
+	level.Warn(f.logger).Log("msg", "limit of blocks exceeded; oldest blocks are not loaded and won't be queried", "limit", f.maxBlocks, "dropped", len(ids)-f.maxBlocks)
 	return nil
 }
 
+var _ PartialAwareMetadataFilter = &IgnoreDeletionMarkFilter{}
+
 // IgnoreDeletionMarkFilter is a filter that filters out the blocks that are marked for deletion after a given delay.
 // The delay duration is to make sure that the replacement block can be fetched before we filter out the old block.
 // Delay is not considered when computing DeletionMarkBlocks map.
@@ -783,16 +2917,80 @@ type IgnoreDeletionMarkFilter struct {
 	concurrency     int
 	bkt             objstore.InstrumentedBucketReader
 	deletionMarkMap map[ulid.ULID]*metadata.DeletionMark
+
+	// Optional detection of deletion marks left behind deleted blocks.
+	detectStaleMarks        bool
+	staleMarksBkt           objstore.Bucket
+	staleMarksInterval      time.Duration
+	lastStaleMarksDetection time.Time
+
+	staleMarksMtx sync.Mutex
+	staleMarks    []ulid.ULID
+	partial       map[ulid.ULID]error
+
+	// Reader of deletion marks, optionally retrying failed reads.
+	markBkt          objstore.InstrumentedBucketReader
+	readRetries      int
+	readRetryBackoff time.Duration
+}
+
+// IgnoreDeletionMarkFilterOption configures optional behaviour of the IgnoreDeletionMarkFilter.
+type IgnoreDeletionMarkFilterOption func(f *IgnoreDeletionMarkFilter)
+
+// WithStaleMarksDetection makes the IgnoreDeletionMarkFilter detect deletion marks of blocks which are otherwise
+// deleted, i.e. the deletion mark is the only object left in the block directory (e.g. after interrupted block.Delete).
+// Those are exposed by StaleMarks. If deleteBkt is not nil, stale marks are also deleted from it, best effort.
+// Candidates are blocks listed by the MetaFetcher without meta.json (see PartialAwareMetadataFilter), so detection only
+// works when the filter is used by a MetaFetcher. Detection lists the directory of each candidate, so it runs on Filter
+// calls at most once per the given interval, or on every call if it's 0.
+func WithStaleMarksDetection(deleteBkt objstore.Bucket, interval time.Duration) IgnoreDeletionMarkFilterOption {
+	return func(f *IgnoreDeletionMarkFilter) {
+		f.detectStaleMarks = true
+		f.staleMarksBkt = deleteBkt
+		f.staleMarksInterval = interval
+	}
+}
+
+// WithDeletionMarkReadRetries makes the IgnoreDeletionMarkFilter retry getting and reading a deletion mark from the bucket
+// up to retries times, waiting backoff in between, before failing the whole filter. Missing deletion marks and marks
+// which content is invalid are never retried.
+func WithDeletionMarkReadRetries(retries int, backoff time.Duration) IgnoreDeletionMarkFilterOption {
+	return func(f *IgnoreDeletionMarkFilter) {
+		f.readRetries = retries
+		f.readRetryBackoff = backoff
+	}
 }
 
 // NewIgnoreDeletionMarkFilter creates IgnoreDeletionMarkFilter.
-func NewIgnoreDeletionMarkFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader, delay time.Duration, concurrency int) *IgnoreDeletionMarkFilter {
-	return &IgnoreDeletionMarkFilter{
+func NewIgnoreDeletionMarkFilter(logger log.Logger, bkt objstore.InstrumentedBucketReader, delay time.Duration, concurrency int, opts ...IgnoreDeletionMarkFilterOption) *IgnoreDeletionMarkFilter {
+	f := &IgnoreDeletionMarkFilter{
 		logger:      logger,
 		bkt:         bkt,
 		delay:       delay,
 		concurrency: concurrency,
+		markBkt:     bkt,
+	}
+	for _, o := range opts {
+		o(f)
+	}
+	if f.readRetries > 0 {
+		f.markBkt = &retryingBucketReader{InstrumentedBucketReader: bkt, logger: f.logger, retries: f.readRetries, backoff: f.readRetryBackoff}
 	}
+	return f
+}
+
+// SetPartial sets partial blocks of the synchronization, which are candidates for stale deletion marks.
+func (f *IgnoreDeletionMarkFilter) SetPartial(partial map[ulid.ULID]error) {
+	f.partial = partial
+}
+
+// StaleMarks returns IDs of blocks which only deletion mark was left in the bucket, found during the last detection.
+// It's empty unless WithStaleMarksDetection is used.
+func (f *IgnoreDeletionMarkFilter) StaleMarks() []ulid.ULID {
+	f.staleMarksMtx.Lock()
+	defer f.staleMarksMtx.Unlock()
+
+	return f.staleMarks
 }
 
 // DeletionMarkBlocks returns block ids that were marked for deletion.
@@ -822,7 +3020,7 @@ func (f *IgnoreDeletionMarkFilter) Filter(ctx context.Context, metas map[ulid.UL
 		eg.Go(func() error {
 			for id := range ch {
 				m := &metadata.DeletionMark{}
-				if err := metadata.ReadMarker(ctx, f.logger, f.bkt, id.String(), m); err != nil {
+				if err := metadata.ReadMarker(ctx, f.logger, f.markBkt, id.String(), m); err != nil {
 					if errors.Cause(err) == metadata.ErrorMarkerNotFound {
 						continue
 					}
@@ -868,6 +3066,82 @@ func (f *IgnoreDeletionMarkFilter) Filter(ctx context.Context, metas map[ulid.UL
 		return errors.Wrap(err, "filter blocks marked for deletion")
 	}
 
+	if f.detectStaleMarks && time.Since(f.lastStaleMarksDetection) >= f.staleMarksInterval {
+		if err := f.findStaleMarks(ctx); err != nil {
+			return errors.Wrap(err, "find stale deletion marks")
+		}
+		f.lastStaleMarksDetection = time.Now()
+	}
+	return nil
+}
+
+// findStaleMarks looks for directories of partial blocks without meta.json with the deletion mark as the only object.
+func (f *IgnoreDeletionMarkFilter) findStaleMarks(ctx context.Context) error {
+	var candidates []ulid.ULID
+	for id, err := range f.partial {
+		if errors.Cause(err) == ErrorSyncMetaNotFound {
+			candidates = append(candidates, id)
+		}
+	}
+
+	var (
+		eg    errgroup.Group
+		ch    = make(chan ulid.ULID, f.concurrency)
+		mtx   sync.Mutex
+		stale []ulid.ULID
+	)
+	for i := 0; i < f.concurrency; i++ {
+		eg.Go(func() error {
+			for id := range ch {
+				var objects []string
+				if err := f.bkt.Iter(ctx, id.String(), func(name string) error {
+					objects = append(objects, name)
+					return nil
+				}); err != nil {
+					return errors.Wrapf(err, "iter block %v", id)
+				}
+				if len(objects) != 1 || objects[0] != path.Join(id.String(), metadata.DeletionMarkFilename) {
+					continue
+				}
+
+				mtx.Lock()
+				stale = append(stale, id)
+				mtx.Unlock()
+
+				if f.staleMarksBkt == nil {
+					continue
+				}
+				markFile := path.Join(id.String(), metadata.DeletionMarkFilename)
+				if err := f.staleMarksBkt.Delete(ctx, markFile); err != nil {
+					level.Warn(f.logger).Log("msg", "best effort delete of stale deletion mark failed; ignoring", "block", id, "err", err)
+					continue
+				}
+				level.Info(f.logger).Log("msg", "deleted stale deletion mark", "block", id)
+			}
+			return nil
+		})
+	}
+
+	eg.Go(func() error {
+		defer close(ch)
+
+		for _, id := range candidates {
+			select {
+			case ch <- id:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Compare(stale[j]) < 0 })
+	f.staleMarksMtx.Lock()
+	f.staleMarks = stale
+	f.staleMarksMtx.Unlock()
 	return nil
 }
 
@@ -890,3 +3164,63 @@ func ParseRelabelConfig(contentYaml []byte, supportedActions map[relabel.Action]
 
 	return relabelConfig, nil
 }
+
+// retryingBucketReader retries failed Get calls, including reading of the whole object, which has to be small. Calls of
+// objects that don't exist are not retried.
+type retryingBucketReader struct {
+	objstore.InstrumentedBucketReader
+
+	logger  log.Logger
+	retries int
+	backoff time.Duration
+}
+
+func (b *retryingBucketReader) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return b.reader(b.InstrumentedBucketReader).Get(ctx, name)
+}
+
+func (b *retryingBucketReader) ReaderWithExpectedErrs(fn objstore.IsOpFailureExpectedFunc) objstore.BucketReader {
+	return b.reader(b.InstrumentedBucketReader.ReaderWithExpectedErrs(fn))
+}
+
+func (b *retryingBucketReader) reader(r objstore.BucketReader) *retryingReader {
+	return &retryingReader{BucketReader: r, logger: b.logger, retries: b.retries, backoff: b.backoff}
+}
+
+// retryingReader is the objstore.BucketReader counterpart of retryingBucketReader.
+type retryingReader struct {
+	objstore.BucketReader
+
+	logger  log.Logger
+	retries int
+	backoff time.Duration
+}
+
+func (r *retryingReader) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	for i := 0; ; i++ {
+		b, err := r.getAll(ctx, name)
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(b)), nil
+		}
+		if i >= r.retries || r.IsObjNotFoundErr(err) {
+			return nil, err
+		}
+		level.Debug(r.logger).Log("msg", "failed to get object, retrying", "name", name, "attempt", i+1, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(r.backoff):
+		}
+	}
+}
+
+func (r *retryingReader) getAll(ctx context.Context, name string) ([]byte, error) {
+	rc, err := r.BucketReader.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer runutil.CloseWithLogOnErr(r.logger, rc, "close bkt object reader")
+
+	return ioutil.ReadAll(rc)
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -15,14 +16,21 @@ import (
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/pkg/timestamp"
 	"github.com/prometheus/prometheus/tsdb"
 	"github.com/thanos-io/thanos/pkg/block/metadata"
 	"github.com/thanos-io/thanos/pkg/extprom"
@@ -30,6 +38,7 @@ import (
 	"github.com/thanos-io/thanos/pkg/objstore"
 	"github.com/thanos-io/thanos/pkg/objstore/objtesting"
 	"github.com/thanos-io/thanos/pkg/testutil"
+	"github.com/thanos-io/thanos/pkg/tracing"
 )
 
 func newTestFetcherMetrics() *FetcherMetrics {
@@ -295,6 +304,1642 @@ func TestMetaFetcher_Fetch(t *testing.T) {
 	})
 }
 
+func uploadTestMeta(t testing.TB, ctx context.Context, bkt objstore.Bucket, meta metadata.Meta) {
+	var buf bytes.Buffer
+	testutil.Ok(t, json.NewEncoder(&buf).Encode(&meta))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(meta.ULID.String(), metadata.MetaFilename), &buf))
+}
+
+func TestBaseFetcher_PartialPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)}})
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(2).String(), "some-file"), bytes.NewBufferString("something")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(3).String(), MetaFilename), bytes.NewBufferString("{ not a json")))
+
+	for _, tcase := range []struct {
+		policy          PartialPolicy
+		expectedMetaErr []string
+	}{
+		{
+			policy: PartialPolicyNone,
+		},
+		{
+			policy:          PartialPolicyCorrupted,
+			expectedMetaErr: []string{"incomplete view: ", ErrorSyncMetaCorrupted.Error()},
+		},
+		{
+			policy:          PartialPolicyAll,
+			expectedMetaErr: []string{"incomplete view: 2 errors: ", ErrorSyncMetaCorrupted.Error(), ErrorSyncMetaNotFound.Error()},
+		},
+	} {
+		t.Run(fmt.Sprintf("policy %d", tcase.policy), func(t *testing.T) {
+			baseFetcher, err := NewBaseFetcher(log.NewNopLogger(), 20, objstore.WithNoopInstr(bkt), "", nil, WithPartialPolicy(tcase.policy))
+			testutil.Ok(t, err)
+			fetcher := baseFetcher.NewMetaFetcher(nil, nil, nil)
+
+			metas, partial, err := fetcher.Fetch(ctx)
+			compareSliceWithMapKeys(t, metas, ULIDs(1))
+			testutil.Equals(t, 2, len(partial))
+
+			if len(tcase.expectedMetaErr) == 0 {
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, len(baseFetcher.cached))
+				return
+			}
+			testutil.NotOk(t, err)
+			for _, e := range tcase.expectedMetaErr {
+				testutil.Assert(t, strings.Contains(err.Error(), e), "expected %q in error %v", e, err)
+			}
+			// Incomplete view should not update the cache.
+			testutil.Equals(t, 0, len(baseFetcher.cached))
+		})
+	}
+}
+
+func TestBaseFetcher_FetchStream(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 50; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(51).String(), "some-file"), bytes.NewBufferString("something")))
+
+	baseFetcher, err := NewBaseFetcher(log.NewNopLogger(), 4, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+
+	ch, err := baseFetcher.FetchStream(ctx)
+	testutil.Ok(t, err)
+
+	seen := map[ulid.ULID]int{}
+	for r := range ch {
+		seen[r.ID]++
+		if r.ID == ULID(51) {
+			testutil.Equals(t, ErrorSyncMetaNotFound, errors.Cause(r.Err))
+			continue
+		}
+		testutil.Ok(t, r.Err)
+		testutil.Equals(t, r.ID, r.Meta.ULID)
+	}
+	testutil.Equals(t, 51, len(seen))
+	for id, n := range seen {
+		testutil.Equals(t, 1, n, "block %v emitted more than once", id)
+	}
+}
+
+func TestBaseFetcher_CompressedDiskCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-meta-fetcher-compressed")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	meta := metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"cached": "true"}},
+	}
+	uploadTestMeta(t, ctx, bkt, meta)
+
+	for _, tcase := range []struct {
+		compressed       bool
+		expectedFilename string
+	}{
+		{compressed: false, expectedFilename: MetaFilename},
+		{compressed: true, expectedFilename: cachedMetaGzipFilename},
+	} {
+		t.Run(fmt.Sprintf("compressed=%v", tcase.compressed), func(t *testing.T) {
+			cachedBlockDir := filepath.Join(dir, "meta-syncer", ULID(1).String())
+			testutil.Ok(t, os.RemoveAll(cachedBlockDir))
+
+			// Fill disk cache.
+			uploadTestMeta(t, ctx, bkt, meta)
+			f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), dir, nil, WithCompressedDiskCache(tcase.compressed))
+			testutil.Ok(t, err)
+			_, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+			testutil.Ok(t, err)
+
+			fis, err := ioutil.ReadDir(cachedBlockDir)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(fis))
+			testutil.Equals(t, tcase.expectedFilename, fis[0].Name())
+
+			// Change meta in the bucket, so we know if meta was served from the disk cache.
+			changed := meta
+			changed.Thanos.Labels = map[string]string{"cached": "false"}
+			uploadTestMeta(t, ctx, bkt, changed)
+
+			// Both formats should be auto-detected on read.
+			for _, compressed := range []bool{false, true} {
+				f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), dir, nil, WithCompressedDiskCache(compressed))
+				testutil.Ok(t, err)
+				metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+				testutil.Ok(t, err)
+				testutil.Equals(t, map[string]string{"cached": "true"}, metas[ULID(1)].Thanos.Labels)
+			}
+		})
+	}
+}
+
+// slowBucket is a bucket that delays each Exists call.
+type slowBucket struct {
+	objstore.Bucket
+
+	delay time.Duration
+}
+
+func (b slowBucket) Exists(ctx context.Context, name string) (bool, error) {
+	select {
+	case <-ctx.Done():
+		return false, ctx.Err()
+	case <-time.After(b.delay):
+	}
+	return b.Bucket.Exists(ctx, name)
+}
+
+func TestBaseFetcher_IterBlockedMetric(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 10; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	t.Run("fast load", func(t *testing.T) {
+		f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+		testutil.Ok(t, err)
+		_, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(f.iterBlocked))
+	})
+	t.Run("slow load", func(t *testing.T) {
+		f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(slowBucket{Bucket: bkt, delay: 10 * time.Millisecond}), "", nil)
+		testutil.Ok(t, err)
+		_, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+		testutil.Ok(t, err)
+		testutil.Assert(t, promtest.ToFloat64(f.iterBlocked) > 0, "expected iteration to be blocked by slow workers")
+	})
+}
+
+type staticFetcher struct {
+	metas   map[ulid.ULID]*metadata.Meta
+	partial map[ulid.ULID]error
+	err     error
+}
+
+func (f staticFetcher) Fetch(context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	return f.metas, f.partial, f.err
+}
+
+func (f staticFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+// scriptedFetcher records times of Fetch calls and fails the ones for which fail returns true.
+type scriptedFetcher struct {
+	fail  func(call int) bool
+	calls []time.Time
+}
+
+func (f *scriptedFetcher) Fetch(context.Context) (map[ulid.ULID]*metadata.Meta, map[ulid.ULID]error, error) {
+	f.calls = append(f.calls, time.Now())
+	if f.fail(len(f.calls)) {
+		return nil, nil, errors.New("fetch failed")
+	}
+	return map[ulid.ULID]*metadata.Meta{ULID(1): {}}, nil, nil
+}
+
+func (f *scriptedFetcher) UpdateOnChange(func([]metadata.Meta, error)) {}
+
+func TestRunPeriodic(t *testing.T) {
+	const interval = 10 * time.Millisecond
+
+	run := func(f *scriptedFetcher, jitter time.Duration, calls int) []error {
+		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+		defer cancel()
+
+		var errs []error
+		RunPeriodic(ctx, f, interval, jitter, func(metas map[ulid.ULID]*metadata.Meta, _ map[ulid.ULID]error, err error) {
+			errs = append(errs, err)
+			if err == nil {
+				testutil.Equals(t, 1, len(metas))
+			}
+			if len(errs) == calls {
+				cancel()
+			}
+		})
+		testutil.Equals(t, calls, len(f.calls))
+		return errs
+	}
+
+	t.Run("success", func(t *testing.T) {
+		f := &scriptedFetcher{fail: func(int) bool { return false }}
+		start := time.Now()
+		for _, err := range run(f, 5*time.Millisecond, 5) {
+			testutil.Ok(t, err)
+		}
+		testutil.Assert(t, f.calls[0].Sub(start) < 5*time.Millisecond+time.Second, "first fetch should be only delayed by jitter")
+		for i := 1; i < len(f.calls); i++ {
+			gap := f.calls[i].Sub(f.calls[i-1])
+			testutil.Assert(t, gap >= interval, "fetch %d came too early: %v", i, gap)
+			testutil.Assert(t, gap < interval+5*time.Millisecond+time.Second, "fetch %d came too late: %v", i, gap)
+		}
+	})
+	t.Run("backoff on errors", func(t *testing.T) {
+		// Fetches 2, 3 and 4 fail.
+		f := &scriptedFetcher{fail: func(call int) bool { return call >= 2 && call <= 4 }}
+		errs := run(f, 0, 6)
+		testutil.Ok(t, errs[0])
+		testutil.NotOk(t, errs[1])
+		testutil.Ok(t, errs[4])
+
+		gaps := make([]time.Duration, 0, len(f.calls)-1)
+		for i := 1; i < len(f.calls); i++ {
+			gaps = append(gaps, f.calls[i].Sub(f.calls[i-1]))
+		}
+		testutil.Assert(t, gaps[1] >= 2*interval, "expected backoff after first failure, got %v", gaps[1])
+		testutil.Assert(t, gaps[2] >= 4*interval, "expected backoff after second failure, got %v", gaps[2])
+		testutil.Assert(t, gaps[3] >= 8*interval, "expected backoff after third failure, got %v", gaps[3])
+		// Backoff is reset after success.
+		testutil.Assert(t, gaps[4] < 8*interval, "expected backoff to be reset, got %v", gaps[4])
+	})
+}
+
+func TestMergingFetcher_Fetch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	region1 := staticFetcher{
+		metas:   map[ulid.ULID]*metadata.Meta{ULID(1): {}, ULID(2): {}},
+		partial: map[ulid.ULID]error{ULID(10): ErrorSyncMetaNotFound},
+	}
+	region2 := staticFetcher{
+		metas:   map[ulid.ULID]*metadata.Meta{ULID(3): {}},
+		partial: map[ulid.ULID]error{ULID(11): ErrorSyncMetaCorrupted},
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		var listened []metadata.Meta
+		f := NewMergingFetcher(region1, region2)
+		f.UpdateOnChange(func(blocks []metadata.Meta, err error) { listened = blocks })
+
+		metas, partial, err := f.Fetch(ctx)
+		testutil.Ok(t, err)
+		compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3))
+		testutil.Equals(t, map[ulid.ULID]error{ULID(10): ErrorSyncMetaNotFound, ULID(11): ErrorSyncMetaCorrupted}, partial)
+		testutil.Equals(t, 3, len(listened))
+	})
+	t.Run("collision", func(t *testing.T) {
+		region3 := staticFetcher{metas: map[ulid.ULID]*metadata.Meta{ULID(3): {}, ULID(4): {}}}
+
+		metas, _, err := NewMergingFetcher(region1, region2, region3).Fetch(ctx)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, fmt.Sprintf("incomplete view: block %s returned by more than one fetcher", ULID(3)), err.Error())
+		compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3, 4))
+	})
+	t.Run("one fetcher errors", func(t *testing.T) {
+		failing := staticFetcher{
+			metas: map[ulid.ULID]*metadata.Meta{ULID(4): {}},
+			err:   errors.New("incomplete view: some error"),
+		}
+
+		metas, partial, err := NewMergingFetcher(region1, failing, region2).Fetch(ctx)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, "incomplete view: fetcher 1: incomplete view: some error", err.Error())
+		compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3, 4))
+		testutil.Equals(t, 2, len(partial))
+	})
+}
+
+func TestBaseFetcher_DiskCacheInterruptedWrite(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-meta-fetcher-interrupted-write")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	meta := metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"a": "b"}},
+	}
+	uploadTestMeta(t, ctx, bkt, meta)
+
+	var buf bytes.Buffer
+	testutil.Ok(t, meta.Write(&buf))
+	truncated := buf.Bytes()[:buf.Len()/2]
+
+	for _, compressed := range []bool{false, true} {
+		filename := MetaFilename
+		if compressed {
+			filename = cachedMetaGzipFilename
+		}
+		for _, leftover := range []string{filename + ".tmp", filename} {
+			t.Run(fmt.Sprintf("compressed=%v,leftover=%v", compressed, leftover), func(t *testing.T) {
+				cachedBlockDir := filepath.Join(dir, "meta-syncer", ULID(1).String())
+				testutil.Ok(t, os.RemoveAll(cachedBlockDir))
+
+				// Simulate the process killed in the middle of writing the cached meta.
+				testutil.Ok(t, os.MkdirAll(cachedBlockDir, os.ModePerm))
+				testutil.Ok(t, ioutil.WriteFile(filepath.Join(cachedBlockDir, leftover), truncated, os.ModePerm))
+
+				f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), dir, nil, WithCompressedDiskCache(compressed))
+				testutil.Ok(t, err)
+				metas, partial, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+				testutil.Ok(t, err)
+				testutil.Equals(t, 0, len(partial))
+				testutil.Equals(t, meta.Thanos.Labels, metas[ULID(1)].Thanos.Labels)
+
+				// Cache is healed: only the complete meta file is left.
+				fis, err := ioutil.ReadDir(cachedBlockDir)
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, len(fis))
+				testutil.Equals(t, filename, fis[0].Name())
+
+				m, err := f.readCachedMeta(cachedBlockDir)
+				testutil.Ok(t, err)
+				testutil.Equals(t, meta.Thanos.Labels, m.Thanos.Labels)
+			})
+		}
+	}
+}
+
+func TestBaseFetcher_DiskCacheSync(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)}})
+
+	for _, compressed := range []bool{false, true} {
+		filename := MetaFilename
+		if compressed {
+			filename = cachedMetaGzipFilename
+		}
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			for _, syncErr := range []error{nil, errors.New("sync failed")} {
+				dir, err := ioutil.TempDir("", "test-meta-fetcher-sync")
+				testutil.Ok(t, err)
+				defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+				f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), dir, nil, WithCompressedDiskCache(compressed))
+				testutil.Ok(t, err)
+				var synced []string
+				f.syncFile = func(file *os.File) error {
+					synced = append(synced, filepath.Base(file.Name()))
+					return syncErr
+				}
+
+				metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+				testutil.Ok(t, err)
+				testutil.Equals(t, 1, len(metas))
+				testutil.Equals(t, []string{filename + ".tmp"}, synced)
+
+				fis, err := ioutil.ReadDir(filepath.Join(dir, "meta-syncer", ULID(1).String()))
+				testutil.Ok(t, err)
+				if syncErr != nil {
+					// Unsynced content is never renamed into place.
+					testutil.Equals(t, 0, len(fis))
+					continue
+				}
+				testutil.Equals(t, 1, len(fis))
+				testutil.Equals(t, filename, fis[0].Name())
+			}
+		})
+	}
+}
+
+func TestBaseFetcher_ConsolidatedWarnings(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 10; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	for _, consolidated := range []bool{false, true} {
+		t.Run(fmt.Sprintf("consolidated=%v", consolidated), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-meta-fetcher-consolidated-warnings")
+			testutil.Ok(t, err)
+			defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+			var (
+				mtx      sync.Mutex
+				warnings = map[string][]map[string]interface{}{}
+			)
+			logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+				kv := map[string]interface{}{}
+				for i := 0; i+1 < len(keyvals); i += 2 {
+					kv[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+				}
+				if fmt.Sprint(kv["level"]) != "warn" {
+					return nil
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				msg := fmt.Sprint(kv["msg"])
+				warnings[msg] = append(warnings[msg], kv)
+				return nil
+			})
+
+			f, err := NewBaseFetcher(logger, 10, objstore.WithNoopInstr(bkt), dir, nil, WithConsolidatedWarnings(consolidated))
+			testutil.Ok(t, err)
+
+			// Break the disk cache, so every cache write fails.
+			testutil.Ok(t, os.RemoveAll(f.cacheDir))
+			testutil.Ok(t, ioutil.WriteFile(f.cacheDir, []byte("not a directory"), os.ModePerm))
+
+			metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 10, len(metas))
+
+			mkdirWarnings := warnings["best effort mkdir of the meta.json block dir failed; ignoring"]
+			if !consolidated {
+				testutil.Equals(t, 10, len(mkdirWarnings))
+				return
+			}
+			for msg, ws := range warnings {
+				testutil.Equals(t, 1, len(ws), "expected single warning for %q", msg)
+			}
+			testutil.Equals(t, 1, len(mkdirWarnings))
+			testutil.Equals(t, 10, mkdirWarnings[0]["count"])
+			testutil.Assert(t, mkdirWarnings[0]["err"] != nil, "expected error of the first occurrence")
+		})
+	}
+}
+
+func TestBaseFetcher_DiskCacheCleanupInterval(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-meta-fetcher-cleanup")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)}})
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), dir, nil, WithDiskCacheCleanupInterval(3))
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+	orphanDir := filepath.Join(dir, "meta-syncer", ULID(2).String())
+	for i, expectCleanup := range []bool{true, false, false, true, false} {
+		testutil.Ok(t, os.MkdirAll(orphanDir, os.ModePerm))
+
+		_, _, err := fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+
+		_, err = os.Stat(orphanDir)
+		testutil.Equals(t, expectCleanup, os.IsNotExist(err), "fetch %d", i)
+		_, err = os.Stat(filepath.Join(dir, "meta-syncer", ULID(1).String()))
+		testutil.Ok(t, err)
+	}
+}
+
+func TestBaseFetcher_FetchTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 20; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(slowBucket{Bucket: bkt, delay: 100 * time.Millisecond}), "", nil, WithFetchTimeout(200*time.Millisecond))
+	testutil.Ok(t, err)
+
+	start := time.Now()
+	metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Assert(t, time.Since(start) < 1*time.Second, "fetch took %v", time.Since(start))
+	testutil.NotOk(t, err)
+	testutil.Assert(t, errors.Is(err, context.DeadlineExceeded), "expected deadline exceeded, got %v", err)
+	testutil.Assert(t, strings.HasPrefix(err.Error(), "incomplete view: fetch timed out after 200ms"), "unexpected error %v", err)
+	testutil.Assert(t, len(metas) > 0 && len(metas) < 20, "expected partial view, got %d blocks", len(metas))
+	testutil.Equals(t, 0, len(f.cached))
+
+	// Cancellation by the caller is not a timeout.
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	metas, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(cctx)
+	testutil.NotOk(t, err)
+	testutil.Assert(t, !strings.Contains(err.Error(), "timed out"), "unexpected error %v", err)
+	testutil.Equals(t, 0, len(metas))
+}
+
+// cancelingBucket cancels the context after given number of Get calls.
+type cancelingBucket struct {
+	objstore.Bucket
+
+	mtx    sync.Mutex
+	gets   int
+	after  int
+	cancel context.CancelFunc
+}
+
+func (b *cancelingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.gets++
+	if b.gets == b.after {
+		b.cancel()
+	}
+	b.mtx.Unlock()
+	return b.Bucket.Get(ctx, name)
+}
+
+// namesBucket returns given names on Iter of the bucket root.
+type namesBucket struct {
+	objstore.Bucket
+
+	names []string
+}
+
+func (b *namesBucket) Iter(_ context.Context, _ string, f func(string) error, _ ...objstore.IterOption) error {
+	for _, n := range b.names {
+		if err := f(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBaseFetcher_NonCanonicalBlockDirNames(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 4; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	nbkt := &namesBucket{Bucket: bkt, names: []string{
+		ULID(1).String() + "/",
+		ULID(2).String(),
+		path.Join("prefix", ULID(3).String()) + "/",
+		ULID(4).String() + "//",
+		// Same block in other form.
+		ULID(1).String(),
+		"not-a-block/",
+	}}
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(nbkt), "", nil)
+	testutil.Ok(t, err)
+
+	metas, partial, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(partial))
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2, 3, 4))
+	testutil.Equals(t, 4.0, promtest.ToFloat64(f.nonCanonicalNames))
+}
+
+func TestBaseFetcher_BlockDirPredicate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 4; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+	nbkt := &namesBucket{Bucket: bkt, names: []string{
+		path.Join("blocks", ULID(1).String()) + "/",
+		path.Join("blocks", ULID(2).String()) + "/",
+		path.Join("other", ULID(3).String()) + "/",
+		ULID(4).String() + "/",
+	}}
+
+	// Only ULID-shaped directories under blocks/ are considered.
+	predicate := func(name string) (ulid.ULID, bool) {
+		if !strings.HasPrefix(name, "blocks/") {
+			return ulid.ULID{}, false
+		}
+		return IsBlockDir(name)
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		opts     []BaseFetcherOption
+		expected []ulid.ULID
+	}{
+		{name: "default", expected: ULIDs(1, 2, 3, 4)},
+		{name: "custom predicate", opts: []BaseFetcherOption{WithBlockDirPredicate(predicate)}, expected: ULIDs(1, 2)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(nbkt), "", nil, tcase.opts...)
+			testutil.Ok(t, err)
+
+			metas, partial, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 0, len(partial))
+			compareSliceWithMapKeys(t, metas, tcase.expected)
+		})
+	}
+}
+
+// delayingBucket delays Get of given objects.
+type delayingBucket struct {
+	objstore.Bucket
+
+	delays map[string]time.Duration
+}
+
+func (b *delayingBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	time.Sleep(b.delays[name])
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestMetaFetcher_SlowestBlocks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 6; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+	dbkt := &delayingBucket{Bucket: bkt, delays: map[string]time.Duration{
+		path.Join(ULID(2).String(), MetaFilename): 60 * time.Millisecond,
+		path.Join(ULID(4).String(), MetaFilename): 40 * time.Millisecond,
+		path.Join(ULID(5).String(), MetaFilename): 20 * time.Millisecond,
+	}}
+	ids := func(timings []BlockTiming) []ulid.ULID {
+		res := make([]ulid.ULID, 0, len(timings))
+		for _, bt := range timings {
+			res = append(res, bt.ID)
+		}
+		return res
+	}
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(dbkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(fetcher.SlowestBlocks(3)))
+
+	f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(dbkt), "", nil, WithSlowestBlocksTracking(2))
+	testutil.Ok(t, err)
+	fetcher = f.NewMetaFetcher(nil, nil, nil)
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	slowest := fetcher.SlowestBlocks(3)
+	testutil.Equals(t, ULIDs(2, 4), ids(slowest))
+	testutil.Assert(t, slowest[0].Duration >= 60*time.Millisecond, "unexpected duration %v", slowest[0].Duration)
+	testutil.Assert(t, slowest[1].Duration >= 40*time.Millisecond, "unexpected duration %v", slowest[1].Duration)
+	testutil.Equals(t, ULIDs(2), ids(fetcher.SlowestBlocks(1)))
+
+	// Second sync hits the in-memory cache, so the slowest blocks change.
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(fetcher.SlowestBlocks(2)))
+	for _, bt := range fetcher.SlowestBlocks(2) {
+		testutil.Assert(t, bt.Duration < slowest[0].Duration, "unexpected duration %v of cached block %v", bt.Duration, bt.ID)
+	}
+}
+
+func TestBaseFetcher_PartialResultsOnCancel(t *testing.T) {
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 100; i++ {
+		uploadTestMeta(t, context.Background(), bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	for _, partialOnCancel := range []bool{false, true} {
+		t.Run(fmt.Sprintf("partialOnCancel=%v", partialOnCancel), func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			cbkt := &cancelingBucket{Bucket: bkt, after: 3, cancel: cancel}
+			f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(cbkt), "", nil, WithPartialResultsOnCancel(partialOnCancel))
+			testutil.Ok(t, err)
+
+			metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+			testutil.NotOk(t, err)
+			testutil.Equals(t, context.Canceled, errors.Cause(err))
+			if !partialOnCancel {
+				testutil.Equals(t, 0, len(metas))
+				return
+			}
+			testutil.Assert(t, len(metas) >= 3 && len(metas) < 100, "expected partial metas, got %d", len(metas))
+			for id, m := range metas {
+				testutil.Equals(t, id, m.ULID)
+			}
+		})
+	}
+}
+
+type inMemMetaCache struct {
+	mtx   sync.Mutex
+	metas map[ulid.ULID]*metadata.Meta
+	hits  int
+}
+
+func (c *inMemMetaCache) Get(id ulid.ULID) (*metadata.Meta, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	m, ok := c.metas[id]
+	if ok {
+		c.hits++
+	}
+	return m, ok
+}
+
+func (c *inMemMetaCache) Set(id ulid.ULID, m *metadata.Meta) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.metas[id] = m
+}
+
+func TestBaseFetcher_MetaCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 5; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+	// Never cancels, used only to count Get calls.
+	cbkt := &cancelingBucket{Bucket: bkt, cancel: func() {}}
+	cache := &inMemMetaCache{metas: map[ulid.ULID]*metadata.Meta{}}
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(cbkt), "", nil, WithMetaCache(cache))
+	testutil.Ok(t, err)
+	metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(metas))
+	testutil.Equals(t, 5, cbkt.gets)
+	testutil.Equals(t, 5, len(cache.metas))
+	testutil.Equals(t, 0, cache.hits)
+
+	// Fresh fetcher, e.g. another process, gets all metas from the shared cache.
+	f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(cbkt), "", nil, WithMetaCache(cache))
+	testutil.Ok(t, err)
+	cachedMetas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, metas, cachedMetas)
+	testutil.Equals(t, 5, cbkt.gets)
+	testutil.Equals(t, 5, cache.hits)
+
+	// Metas from the shared cache fill the disk cache, which is consulted first.
+	dir, err := ioutil.TempDir("", "test-meta-cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(cbkt), dir, nil, WithMetaCache(cache))
+	testutil.Ok(t, err)
+	_, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 10, cache.hits)
+
+	f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(cbkt), dir, nil, WithMetaCache(cache))
+	testutil.Ok(t, err)
+	cachedMetas, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(cachedMetas))
+	testutil.Equals(t, 5, cbkt.gets)
+	testutil.Equals(t, 10, cache.hits)
+}
+
+func TestBaseFetcher_MetaDecodeDuration(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 3; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+	// Only metas fetched from the bucket are decoded, the second sync hits the in-memory cache.
+	for i := 0; i < 2; i++ {
+		_, _, err = fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+
+		m := &dto.Metric{}
+		testutil.Ok(t, f.decodeDuration.Write(m))
+		testutil.Equals(t, uint64(3), m.GetHistogram().GetSampleCount())
+		testutil.Assert(t, m.GetHistogram().GetSampleSum() > 0, "expected non-zero decode duration")
+	}
+}
+
+func TestBaseFetcher_MetaValidation(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	lset := map[string]string{"cluster": "a"}
+	for _, m := range []metadata.Meta{
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1), MinTime: 0, MaxTime: 100}, Thanos: metadata.Thanos{Labels: lset}},
+		// Parseable, but semantically invalid metas.
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(2)}, Thanos: metadata.Thanos{Labels: lset}},
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(3), MinTime: 100, MaxTime: 50}, Thanos: metadata.Thanos{Labels: lset}},
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(4), MinTime: 0, MaxTime: 100}, Thanos: metadata.Thanos{Labels: lset, Downsample: metadata.ThanosDownsample{Resolution: -1}}},
+		// Invalid only if labels are required.
+		{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(5), MinTime: 0, MaxTime: 100}},
+	} {
+		uploadTestMeta(t, ctx, bkt, m)
+	}
+
+	for _, tcase := range []struct {
+		name            string
+		opts            []BaseFetcherOption
+		expectedMetas   []ulid.ULID
+		expectedPartial []ulid.ULID
+	}{
+		{
+			name:          "no validation",
+			expectedMetas: ULIDs(1, 2, 3, 4, 5),
+		},
+		{
+			name:            "validation",
+			opts:            []BaseFetcherOption{WithMetaValidation(false)},
+			expectedMetas:   ULIDs(1, 5),
+			expectedPartial: ULIDs(2, 3, 4),
+		},
+		{
+			name:            "validation with required labels",
+			opts:            []BaseFetcherOption{WithMetaValidation(true)},
+			expectedMetas:   ULIDs(1),
+			expectedPartial: ULIDs(2, 3, 4, 5),
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, tcase.opts...)
+			testutil.Ok(t, err)
+			fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+			metas, partial, err := fetcher.Fetch(ctx)
+			testutil.Ok(t, err)
+			compareSliceWithMapKeys(t, metas, tcase.expectedMetas)
+			testutil.Equals(t, len(tcase.expectedPartial), len(partial))
+			for _, id := range tcase.expectedPartial {
+				testutil.Equals(t, ErrorSyncMetaInvalid, errors.Cause(partial[id]))
+			}
+			testutil.Equals(t, float64(len(tcase.expectedPartial)), promtest.ToFloat64(fetcher.metrics.Synced.WithLabelValues(InvalidMeta)))
+		})
+	}
+}
+
+func TestMetaFetcher_PartialRatio(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	testutil.Equals(t, 0.0, PartialRatio(nil, nil))
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 6; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+	// One block without meta.json and one with corrupted one.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(7).String(), "index"), bytes.NewBufferString("index")))
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(8).String(), MetaFilename), bytes.NewBufferString("{ not a meta")))
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+	metas, partial, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0.25, PartialRatio(metas, partial))
+	testutil.Equals(t, 0.25, promtest.ToFloat64(fetcher.metrics.PartialRatio))
+
+	// Metric is computed from blocks discovered before filtering.
+	toDelete := ULID(1)
+	fetcher = f.NewMetaFetcher(nil, []MetadataFilter{&ulidFilter{ulidToDelete: &toDelete}}, nil)
+	metas, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, len(metas))
+	testutil.Equals(t, 0.25, promtest.ToFloat64(fetcher.metrics.PartialRatio))
+}
+
+func TestMetaFetcher_LastTotals(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 3; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{
+				Version: 1, ULID: ULID(i), MinTime: int64(i) * 100, MaxTime: int64(i+1) * 100,
+				Stats: tsdb.BlockStats{NumSeries: 10, NumChunks: 20, NumSamples: 30},
+			},
+			Thanos: metadata.Thanos{Files: []metadata.File{{RelPath: "index", SizeBytes: 1000}}},
+		})
+	}
+	// Partial blocks are not accounted.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(4).String(), "index"), bytes.NewBufferString("index")))
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	mint := time.Unix(0, 201*time.Millisecond.Nanoseconds())
+	maxt := time.Unix(0, 1000*time.Millisecond.Nanoseconds())
+	fetcher := f.NewMetaFetcher(nil, []MetadataFilter{
+		NewTimePartitionMetaFilter(model.TimeOrDurationValue{Time: &mint}, model.TimeOrDurationValue{Time: &maxt}),
+	}, nil)
+	testutil.Equals(t, Totals{}, fetcher.LastTotals())
+
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	// Only blocks in the view are accounted, block 1 is filtered out.
+	testutil.Equals(t, Totals{Blocks: 2, Bytes: 2000, Series: 20, Chunks: 40, Samples: 60, Coverage: 200 * time.Millisecond}, fetcher.LastTotals())
+
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(3).String(), MetaFilename)))
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, Totals{Blocks: 1, Bytes: 1000, Series: 10, Chunks: 20, Samples: 30, Coverage: 100 * time.Millisecond}, fetcher.LastTotals())
+}
+
+func TestMetaFetcher_MarshalView(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(2), MinTime: 100, MaxTime: 200, Compaction: tsdb.BlockMetaCompaction{Level: 3}},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"cluster": "eu1"}, Downsample: metadata.ThanosDownsample{Resolution: 300000}},
+	})
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1), MinTime: 0, MaxTime: 100, Compaction: tsdb.BlockMetaCompaction{Level: 1}},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"cluster": "us1"}},
+	})
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(3).String(), MetaFilename), bytes.NewBufferString("{ not a meta")))
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+	testutil.NotOk(t, fetcher.MarshalView(ioutil.Discard))
+
+	_, partial, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+
+	var buf bytes.Buffer
+	testutil.Ok(t, fetcher.MarshalView(&buf))
+
+	var view FetchView
+	testutil.Ok(t, json.Unmarshal(buf.Bytes(), &view))
+	testutil.Equals(t, FetchView{
+		Version: FetchViewVersion,
+		Blocks: []FetchViewBlock{
+			{ULID: ULID(1), Labels: map[string]string{"cluster": "us1"}, MinTime: 0, MaxTime: 100, CompactionLevel: 1},
+			{ULID: ULID(2), Labels: map[string]string{"cluster": "eu1"}, MinTime: 100, MaxTime: 200, Resolution: 300000, CompactionLevel: 3},
+		},
+		Partial: []FetchViewPartial{{ULID: ULID(3), Reason: partial[ULID(3)].Error()}},
+	}, view)
+
+	for _, field := range []string{`"version":1`, `"ulid":"` + ULID(1).String() + `"`, `"labels"`, `"minTime"`, `"maxTime"`, `"resolution"`, `"compactionLevel"`, `"reason"`} {
+		testutil.Assert(t, strings.Contains(buf.String(), field), "expected %s in %s", field, buf.String())
+	}
+
+	// Same view produces the same document.
+	var again bytes.Buffer
+	testutil.Ok(t, fetcher.MarshalView(&again))
+	testutil.Equals(t, buf.String(), again.String())
+}
+
+func TestMetaFetcher_EmitEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for _, id := range ULIDs(1, 2, 3) {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id}})
+	}
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, nil, nil)
+	events := make(chan BlockEvent, 3)
+	fetcher.EmitEvents(events)
+
+	receive := func() []BlockEvent {
+		var res []BlockEvent
+		for {
+			select {
+			case e := <-events:
+				res = append(res, e)
+			default:
+				return res
+			}
+		}
+	}
+
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []BlockEvent{{Type: BlockAdded, ID: ULID(1)}, {Type: BlockAdded, ID: ULID(2)}, {Type: BlockAdded, ID: ULID(3)}}, receive())
+
+	// Nothing changed.
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(receive()))
+
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(2).String(), MetaFilename)))
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(4)}})
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []BlockEvent{{Type: BlockRemoved, ID: ULID(2)}, {Type: BlockAdded, ID: ULID(4)}}, receive())
+	testutil.Equals(t, 0.0, promtest.ToFloat64(fetcher.metrics.DroppedEvents))
+
+	// Events which don't fit into the channel are dropped.
+	for _, id := range ULIDs(5, 6, 7, 8) {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id}})
+	}
+	_, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, []BlockEvent{{Type: BlockAdded, ID: ULID(5)}, {Type: BlockAdded, ID: ULID(6)}, {Type: BlockAdded, ID: ULID(7)}}, receive())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.DroppedEvents))
+}
+
+type testTracer struct {
+	*mocktracer.MockTracer
+}
+
+func (t testTracer) GetTraceIDFromSpanContext(ctx opentracing.SpanContext) (string, bool) {
+	if c, ok := ctx.(mocktracer.MockSpanContext); ok {
+		return fmt.Sprintf("%016x", c.TraceID), true
+	}
+	return "", false
+}
+
+func TestBaseFetcher_SlowSyncExemplars(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)}})
+
+	tracer := testTracer{MockTracer: mocktracer.New()}
+	span, tracedCtx := tracing.StartSpan(tracing.ContextWithTracer(ctx, tracer), "sync")
+	defer span.Finish()
+	traceID, ok := tracer.GetTraceIDFromSpanContext(span.Context())
+	testutil.Assert(t, ok, "expected trace ID")
+
+	exemplarOf := func(t *testing.T, reg *prometheus.Registry) *dto.Exemplar {
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() != "blocks_meta_sync_duration_seconds" {
+				continue
+			}
+			for _, b := range mf.GetMetric()[0].GetHistogram().GetBucket() {
+				if b.GetExemplar() != nil {
+					return b.GetExemplar()
+				}
+			}
+		}
+		return nil
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		ctx      context.Context
+		opts     []BaseFetcherOption
+		expected string
+	}{
+		{name: "disabled", ctx: tracedCtx},
+		{name: "no trace in context", ctx: ctx, opts: []BaseFetcherOption{WithSlowSyncExemplars(0)}},
+		{name: "sync not slow", ctx: tracedCtx, opts: []BaseFetcherOption{WithSlowSyncExemplars(time.Hour)}},
+		{name: "slow sync", ctx: tracedCtx, opts: []BaseFetcherOption{WithSlowSyncExemplars(0)}, expected: traceID},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, tcase.opts...)
+			testutil.Ok(t, err)
+			fetcher := f.NewMetaFetcher(reg, nil, nil)
+
+			_, _, err = fetcher.Fetch(tcase.ctx)
+			testutil.Ok(t, err)
+
+			e := exemplarOf(t, reg)
+			if tcase.expected == "" {
+				testutil.Assert(t, e == nil, "unexpected exemplar %v", e)
+				return
+			}
+			testutil.Assert(t, e != nil, "expected exemplar")
+			testutil.Equals(t, 1, len(e.GetLabel()))
+			testutil.Equals(t, "traceID", e.GetLabel()[0].GetName())
+			testutil.Equals(t, tcase.expected, e.GetLabel()[0].GetValue())
+		})
+	}
+}
+
+func TestBaseFetcher_StrayFilesCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 2; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+		for _, name := range []string{IndexFilename, path.Join(ChunksDirname, "000001"), metadata.DeletionMarkFilename} {
+			testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(i).String(), name), bytes.NewBufferString("data")))
+		}
+	}
+	// Left by interrupted upload.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(2).String(), "index.tmp"), bytes.NewBufferString("data")))
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			f, err := NewBaseFetcher(log.NewLogfmtLogger(log.NewSyncWriter(buf)), 10, objstore.WithNoopInstr(bkt), "", nil, WithStrayFilesCheck(enabled))
+			testutil.Ok(t, err)
+
+			metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 2, len(metas))
+
+			if !enabled {
+				testutil.Assert(t, !strings.Contains(buf.String(), "unexpected files"), "expected no warning, got %q", buf.String())
+				return
+			}
+			testutil.Equals(t, 1, strings.Count(buf.String(), "unexpected files"))
+			testutil.Assert(t, strings.Contains(buf.String(), fmt.Sprintf("block=%s files=%s/index.tmp", ULID(2), ULID(2))), "expected warning about stray file, got %q", buf.String())
+		})
+	}
+}
+
+func TestBaseFetcher_ClockSkewDetection(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	u := &ulidBuilder{}
+	var (
+		now    = time.Now()
+		past   = u.ULID(now.Add(-1 * time.Hour))
+		skewed = u.ULID(now.Add(2 * time.Hour))
+		bkt    = objstore.NewInMemBucket()
+	)
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: past}})
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: skewed}})
+
+	for _, quarantine := range []bool{false, true} {
+		t.Run(fmt.Sprintf("quarantine=%v", quarantine), func(t *testing.T) {
+			f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil, WithClockSkewDetection(time.Hour, quarantine))
+			testutil.Ok(t, err)
+			fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+			metas, partial, err := fetcher.Fetch(ctx)
+			testutil.Ok(t, err)
+			testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.Synced.WithLabelValues(ClockSkewedMeta)))
+			if !quarantine {
+				compareSliceWithMapKeys(t, metas, []ulid.ULID{past, skewed})
+				testutil.Equals(t, 0, len(partial))
+				return
+			}
+			compareSliceWithMapKeys(t, metas, []ulid.ULID{past})
+			testutil.Equals(t, 1, len(partial))
+			testutil.Equals(t, ErrorSyncMetaClockSkewed, errors.Cause(partial[skewed]))
+		})
+	}
+}
+
+func TestBaseFetcher_ProducerVersionRange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	// Block 1 has no producer version.
+	for i, v := range []string{"", "0.18.3", "0.19.0-rc.2", "0.19.0-rc.10", "v0.19.0", "0.19.1+build.1", "0.20.0-rc.0", "0.20.0", "1.0.0", "not-a-version"} {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i + 1)},
+			Thanos:    metadata.Thanos{ProducerVersion: v},
+		})
+	}
+
+	for _, tcase := range []struct {
+		name                   string
+		minVersion, maxVersion string
+		expected               []ulid.ULID
+	}{
+		{name: "no bounds", expected: ULIDs(1, 2, 3, 4, 5, 6, 7, 8, 9)},
+		{name: "release range", minVersion: "0.19.0", maxVersion: "0.19.1", expected: ULIDs(1, 5, 6)},
+		{name: "prerelease bounds", minVersion: "0.19.0-rc.3", maxVersion: "v0.20.0-rc.0", expected: ULIDs(1, 4, 5, 6, 7)},
+		{name: "only max", maxVersion: "0.19.0-rc.2", expected: ULIDs(1, 2, 3)},
+		{name: "only min", minVersion: "0.20.0", expected: ULIDs(1, 8, 9)},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil, WithProducerVersionRange(tcase.minVersion, tcase.maxVersion))
+			testutil.Ok(t, err)
+			fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+			metas, partial, err := fetcher.Fetch(ctx)
+			testutil.Ok(t, err)
+			compareSliceWithMapKeys(t, metas, tcase.expected)
+			testutil.Equals(t, 10-len(tcase.expected), len(partial))
+			for id, err := range partial {
+				testutil.Equals(t, ErrorSyncMetaIncompatibleVersion, errors.Cause(err), "block %v", id)
+			}
+			testutil.Equals(t, float64(len(partial)), promtest.ToFloat64(fetcher.metrics.Synced.WithLabelValues(incompatibleVersionMeta)))
+		})
+	}
+
+	_, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil, WithProducerVersionRange("0.19", ""))
+	testutil.NotOk(t, err)
+}
+
+func TestMetaFetcher_SyncedValue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for _, id := range ULIDs(1, 2) {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{
+			Version: 1, ULID: id, Compaction: tsdb.BlockMetaCompaction{Level: 1, Sources: []ulid.ULID{id}},
+		}})
+	}
+	// Block 3 is compacted from blocks 1 and 2.
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{
+		Version: 1, ULID: ULID(3), Compaction: tsdb.BlockMetaCompaction{Level: 2, Sources: ULIDs(1, 2)},
+	}})
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	fetcher := f.NewMetaFetcher(nil, []MetadataFilter{NewDeduplicateFilter()}, nil)
+
+	metas, _, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(3))
+	testutil.Equals(t, 2.0, fetcher.SyncedValue(duplicateMeta))
+	testutil.Equals(t, 1.0, fetcher.SyncedValue(LoadedMeta))
+
+	// Values reflect only the last Fetch.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(3).String(), MetaFilename)))
+	metas, _, err = fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	compareSliceWithMapKeys(t, metas, ULIDs(1, 2))
+	testutil.Equals(t, 0.0, fetcher.SyncedValue(duplicateMeta))
+	testutil.Equals(t, 2.0, fetcher.SyncedValue(LoadedMeta))
+}
+
+func TestMetaFetcher_FilterStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 10; i++ {
+		cluster := "eu1"
+		if i > 7 {
+			cluster = "us1"
+		}
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i), MinTime: int64(i) * 10, MaxTime: int64(i+1) * 10},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"cluster": cluster}},
+		})
+	}
+
+	// Time filter drops blocks 1 and 2, label filter drops 8, 9 and 10.
+	mint := time.Unix(0, 31*time.Millisecond.Nanoseconds())
+	maxt := time.Unix(0, 200*time.Millisecond.Nanoseconds())
+	expected := []FilterStat{
+		{Filter: "*block.TimePartitionMetaFilter", Entered: 10, Dropped: 2},
+		{Filter: "*block.LabelMatchMetaFilter", Entered: 8, Dropped: 3},
+	}
+	for _, concurrent := range []bool{false, true} {
+		t.Run(fmt.Sprintf("concurrent=%v", concurrent), func(t *testing.T) {
+			f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, WithConcurrentFilters(concurrent))
+			testutil.Ok(t, err)
+			fetcher := f.NewMetaFetcher(nil, []MetadataFilter{
+				NewTimePartitionMetaFilter(model.TimeOrDurationValue{Time: &mint}, model.TimeOrDurationValue{Time: &maxt}),
+				NewLabelMatchMetaFilter([]*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "eu1")}),
+			}, nil)
+			testutil.Equals(t, 0, len(fetcher.FilterStats()))
+
+			metas, _, err := fetcher.Fetch(ctx)
+			testutil.Ok(t, err)
+			compareSliceWithMapKeys(t, metas, ULIDs(3, 4, 5, 6, 7))
+			testutil.Equals(t, expected, fetcher.FilterStats())
+		})
+	}
+}
+
+func TestBaseFetcher_ConcurrentFilters(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	var (
+		u   = &ulidBuilder{}
+		now = time.Now()
+		bkt = objstore.NewInMemBucket()
+	)
+	for i := 0; i < 100; i++ {
+		id := u.ULID(now.Add(-time.Duration(100-i) * 2 * time.Minute))
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id, MinTime: int64(i) * 1000, MaxTime: int64(i+1) * 1000},
+			Thanos: metadata.Thanos{
+				Labels: map[string]string{"shard": fmt.Sprintf("%d", i%3)},
+				Source: metadata.SidecarSource,
+			},
+		})
+	}
+
+	relabelConfig, err := ParseRelabelConfig([]byte(`
+    - action: drop
+      regex: "1"
+      source_labels:
+      - shard
+`), SelectorSupportedRelabelActions)
+	testutil.Ok(t, err)
+
+	mint, maxt := time.Unix(20, 0), time.Unix(80, 0)
+	minTime, maxTime := model.TimeOrDurationValue{Time: &mint}, model.TimeOrDurationValue{Time: &maxt}
+
+	toDelete := u.created[21]
+	fetch := func(concurrent bool) (map[ulid.ULID]*metadata.Meta, *FetcherMetrics) {
+		f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, WithConcurrentFilters(concurrent))
+		testutil.Ok(t, err)
+		fetcher := f.NewMetaFetcher(nil, []MetadataFilter{
+			NewTimePartitionMetaFilter(minTime, maxTime),
+			NewLabelShardedMetaFilter(relabelConfig),
+			NewConsistencyDelayMetaFilter(nil, 2*time.Hour, nil),
+			&ulidFilter{ulidToDelete: &toDelete},
+			NewTimePartitionMetaFilter(minTime, maxTime),
+			NewMaxBlocksMetaFilter(nil, 10),
+		}, nil)
+
+		metas, _, err := fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		return metas, fetcher.metrics
+	}
+
+	seqMetas, seqMetrics := fetch(false)
+	concMetas, concMetrics := fetch(true)
+	testutil.Equals(t, seqMetas, concMetas)
+	for _, state := range []string{LoadedMeta, timeExcludedMeta, labelExcludedMeta, tooFreshMeta, "filtered", blockLimitExceededMeta} {
+		seq := promtest.ToFloat64(seqMetrics.Synced.WithLabelValues(state))
+		testutil.Assert(t, seq > 0, "expected some blocks with state %s", state)
+		testutil.Equals(t, seq, promtest.ToFloat64(concMetrics.Synced.WithLabelValues(state)), "state %s", state)
+	}
+	testutil.Equals(t, 10, len(concMetas))
+}
+
+func TestBaseFetcher_LenientCacheDir(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-lenient-cache-dir")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	// Regular file in place of the parent directory makes cache directory uncreatable, even for root.
+	notDir := filepath.Join(dir, "file")
+	testutil.Ok(t, ioutil.WriteFile(notDir, []byte("not a directory"), os.ModePerm))
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)}})
+
+	_, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), notDir, nil)
+	testutil.NotOk(t, err)
+
+	f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), notDir, nil, WithLenientCacheDir(true))
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", f.cacheDir)
+
+	metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(metas))
+	testutil.Assert(t, metas[ULID(1)] != nil, "expected block to be fetched")
+}
+
+func TestBaseFetcher_ColdDiskCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "test-cold-disk-cache")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var (
+		hotDir  = filepath.Join(dir, "hot")
+		coldDir = filepath.Join(dir, "cold")
+	)
+	tierOf := func(t *testing.T, tierDir string) []ulid.ULID {
+		fis, err := ioutil.ReadDir(filepath.Join(tierDir, "meta-syncer"))
+		testutil.Ok(t, err)
+		var ids []ulid.ULID
+		for _, fi := range fis {
+			if id, ok := IsBlockDir(fi.Name()); ok {
+				ids = append(ids, id)
+			}
+		}
+		return ids
+	}
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 4; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i)}})
+	}
+
+	// Single worker loads metas in order, so last loaded ones stay in the hot tier.
+	f, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), hotDir, nil, WithColdDiskCache(coldDir, 2))
+	testutil.Ok(t, err)
+	metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 4, len(metas))
+	testutil.Equals(t, ULIDs(3, 4), tierOf(t, hotDir))
+	testutil.Equals(t, ULIDs(1, 2), tierOf(t, coldDir))
+
+	// Fresh fetcher picks up the hot tier, promotes accessed meta and demotes the least recently accessed one.
+	f, err = NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), hotDir, nil, WithColdDiskCache(coldDir, 2))
+	testutil.Ok(t, err)
+	m, err := f.loadMeta(ctx, ULID(1))
+	testutil.Ok(t, err)
+	testutil.Equals(t, ULID(1), m.ULID)
+	testutil.Equals(t, ULIDs(1, 4), tierOf(t, hotDir))
+	testutil.Equals(t, ULIDs(2, 3), tierOf(t, coldDir))
+
+	m, err = f.loadMeta(ctx, ULID(4))
+	testutil.Ok(t, err)
+	testutil.Equals(t, ULID(4), m.ULID)
+	m, err = f.loadMeta(ctx, ULID(2))
+	testutil.Ok(t, err)
+	testutil.Equals(t, ULID(2), m.ULID)
+	testutil.Equals(t, ULIDs(2, 4), tierOf(t, hotDir))
+	testutil.Equals(t, ULIDs(1, 3), tierOf(t, coldDir))
+
+	// Returned blocks count as accessed on every sync, also when their metas are served from memory.
+	without3, without4 := ULID(3), ULID(4)
+	metas, _, err = f.NewMetaFetcher(nil, []MetadataFilter{&ulidFilter{ulidToDelete: &without4}}, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(metas))
+	testutil.Equals(t, ULIDs(2, 3), tierOf(t, hotDir))
+	testutil.Equals(t, ULIDs(1, 4), tierOf(t, coldDir))
+
+	metas, _, err = f.NewMetaFetcher(nil, []MetadataFilter{&ulidFilter{ulidToDelete: &without3}}, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 3, len(metas))
+	testutil.Equals(t, ULIDs(2, 4), tierOf(t, hotDir))
+	testutil.Equals(t, ULIDs(1, 3), tierOf(t, coldDir))
+
+	// Both tiers are cleaned up from metas of not loaded blocks.
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(1).String(), MetaFilename)))
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(4).String(), MetaFilename)))
+	_, _, err = f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ULIDs(2, 3), append(tierOf(t, hotDir), tierOf(t, coldDir)...))
+}
+
+func TestBaseFetcher_CachedMetasMemory(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	for i := 1; i <= 5; i++ {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(i), MinTime: int64(i) * 100, MaxTime: int64(i+1) * 100},
+			Thanos:    metadata.Thanos{Labels: map[string]string{"cluster": "a"}},
+		})
+	}
+
+	t.Run("gauge tracks cached metas", func(t *testing.T) {
+		f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+		testutil.Ok(t, err)
+		fetcher := f.NewMetaFetcher(nil, nil, nil)
+
+		metas, _, err := fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		size := estimateMetaSize(metas[ULID(1)])
+		testutil.Assert(t, size > 0, "expected positive size estimate")
+		testutil.Equals(t, float64(5*size), promtest.ToFloat64(f.cachedMetasBytes))
+
+		testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(5).String(), MetaFilename)))
+		_, _, err = fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 4, len(f.cached))
+		testutil.Equals(t, float64(4*size), promtest.ToFloat64(f.cachedMetasBytes))
+	})
+
+	t.Run("hard limit drops oldest metas", func(t *testing.T) {
+		f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+		testutil.Ok(t, err)
+		metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+		testutil.Ok(t, err)
+		size := estimateMetaSize(metas[ULID(1)])
+
+		f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, WithCachedMetasMemoryLimits(size, 2*size+size/2))
+		testutil.Ok(t, err)
+		fetcher := f.NewMetaFetcher(nil, nil, nil)
+		metas, _, err = fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+
+		// Oldest blocks are neither cached nor returned.
+		compareSliceWithMapKeys(t, metas, ULIDs(3, 4))
+		testutil.Equals(t, 2, len(f.cached))
+		testutil.Assert(t, f.cached[ULID(3)] != nil && f.cached[ULID(4)] != nil, "expected newest metas to be cached")
+		testutil.Equals(t, float64(2*size), promtest.ToFloat64(f.cachedMetasBytes))
+		testutil.Equals(t, 2.0, fetcher.SyncedValue(memoryLimitExceededMeta))
+		testutil.Equals(t, 2.0, fetcher.SyncedValue(LoadedMeta))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(f.memLimitedReloads))
+
+		// Dropped metas are loaded again on every sync.
+		_, _, err = fetcher.Fetch(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 2.0, promtest.ToFloat64(f.memLimitedReloads))
+	})
+
+	t.Run("hard limit applies to incomplete view", func(t *testing.T) {
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(6).String(), MetaFilename), bytes.NewBufferString("{ not a meta")))
+		defer func() { testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(6).String(), MetaFilename))) }()
+
+		f, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+		testutil.Ok(t, err)
+		metas, _, err := f.NewMetaFetcher(nil, nil, nil).Fetch(ctx)
+		testutil.Ok(t, err)
+		size := estimateMetaSize(metas[ULID(1)])
+
+		f, err = NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil, WithCachedMetasMemoryLimits(0, 2*size+size/2), WithPartialPolicy(PartialPolicyCorrupted))
+		testutil.Ok(t, err)
+		fetcher := f.NewMetaFetcher(nil, nil, nil)
+		metas, _, err = fetcher.Fetch(ctx)
+		testutil.NotOk(t, err)
+		compareSliceWithMapKeys(t, metas, ULIDs(3, 4))
+		testutil.Equals(t, 0, len(f.cached))
+		testutil.Equals(t, 2.0, fetcher.SyncedValue(memoryLimitExceededMeta))
+	})
+}
+
+func TestValidateFilters(t *testing.T) {
+	var (
+		dedup       = NewDeduplicateFilter()
+		delay       = NewConsistencyDelayMetaFilter(nil, 0, nil)
+		deletion    = NewIgnoreDeletionMarkFilter(log.NewNopLogger(), nil, 0, 1)
+		maxBlocks   = NewMaxBlocksMetaFilter(nil, 10)
+		partitioned = NewTimePartitionMetaFilter(model.TimeOrDurationValue{}, model.TimeOrDurationValue{})
+	)
+
+	for _, tcase := range []struct {
+		name    string
+		filters []MetadataFilter
+		ok      bool
+	}{
+		{name: "no filters", ok: true},
+		{name: "good ordering", filters: []MetadataFilter{partitioned, delay, deletion, dedup, maxBlocks}, ok: true},
+		{name: "dedup before deletion mark filter", filters: []MetadataFilter{delay, dedup, deletion}},
+		{name: "dedup before consistency delay filter", filters: []MetadataFilter{dedup, delay}},
+		{name: "max blocks filter not last", filters: []MetadataFilter{maxBlocks, partitioned}},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			err := ValidateFilters(tcase.filters)
+			if tcase.ok {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.NotOk(t, err)
+		})
+	}
+
+	_, err := NewMetaFetcher(nil, 1, objstore.WithNoopInstr(objstore.NewInMemBucket()), "", nil, []MetadataFilter{dedup, deletion}, nil, WithFilterValidation(true))
+	testutil.NotOk(t, err)
+	_, err = NewMetaFetcher(nil, 1, objstore.WithNoopInstr(objstore.NewInMemBucket()), "", nil, []MetadataFilter{dedup, deletion}, nil)
+	testutil.Ok(t, err)
+}
+
+func TestMetaFetcher_ReapplyModifiers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(1)},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"replica": "a", "rule_replica": "r1", "cluster": "c1"}},
+	})
+	uploadTestMeta(t, ctx, bkt, metadata.Meta{
+		BlockMeta: tsdb.BlockMeta{Version: 1, ULID: ULID(2)},
+		Thanos:    metadata.Thanos{Labels: map[string]string{"replica": "b", "cluster": "c1"}},
+	})
+
+	baseFetcher, err := NewBaseFetcher(log.NewNopLogger(), 10, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+
+	remover := NewReplicaLabelRemover(log.NewNopLogger(), []string{"replica"})
+	fetcher := baseFetcher.NewMetaFetcher(nil, nil, []MetadataModifier{remover})
+
+	_, err = fetcher.ReapplyModifiers(ctx)
+	testutil.NotOk(t, err)
+
+	metas, _, err := fetcher.Fetch(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]string{"rule_replica": "r1", "cluster": "c1"}, metas[ULID(1)].Thanos.Labels)
+	testutil.Equals(t, map[string]string{"cluster": "c1"}, metas[ULID(2)].Thanos.Labels)
+	testutil.Equals(t, 2.0, promtest.ToFloat64(fetcher.metrics.Modified.WithLabelValues(replicaRemovedMeta)))
+
+	// Change replica labels at runtime. Removed labels have to come back, as modifiers are applied to pristine metas.
+	remover.SetReplicaLabels([]string{"rule_replica"})
+	testutil.Ok(t, bkt.Delete(ctx, path.Join(ULID(2).String(), MetaFilename)))
+
+	metas, err = fetcher.ReapplyModifiers(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(metas))
+	testutil.Equals(t, map[string]string{"replica": "a", "cluster": "c1"}, metas[ULID(1)].Thanos.Labels)
+	testutil.Equals(t, map[string]string{"replica": "b", "cluster": "c1"}, metas[ULID(2)].Thanos.Labels)
+	testutil.Equals(t, 1.0, promtest.ToFloat64(fetcher.metrics.Modified.WithLabelValues(replicaRemovedMeta)))
+}
+
 func TestLabelShardedMetaFilter_Filter_Basic(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
@@ -360,6 +2005,116 @@ func TestLabelShardedMetaFilter_Filter_Basic(t *testing.T) {
 
 }
 
+func TestLabelMatchMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	newInput := func() map[ulid.ULID]*metadata.Meta {
+		return map[ulid.ULID]*metadata.Meta{
+			ULID(1): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu1", "tenant": "a"}}},
+			ULID(2): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "eu2", "tenant": "a"}}},
+			ULID(3): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "us1", "tenant": "b"}}},
+			ULID(4): {Thanos: metadata.Thanos{Labels: map[string]string{"cluster": "us1"}}},
+		}
+	}
+
+	for _, tcase := range []struct {
+		name     string
+		matchers []*labels.Matcher
+		expected []ulid.ULID
+	}{
+		{
+			name:     "no matchers",
+			expected: ULIDs(1, 2, 3, 4),
+		},
+		{
+			name:     "equal",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "cluster", "us1")},
+			expected: ULIDs(3, 4),
+		},
+		{
+			name:     "equal to empty matches missing label",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, "tenant", "")},
+			expected: ULIDs(4),
+		},
+		{
+			name:     "not equal",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotEqual, "tenant", "a")},
+			expected: ULIDs(3, 4),
+		},
+		{
+			name:     "regexp",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchRegexp, "cluster", "eu.*")},
+			expected: ULIDs(1, 2),
+		},
+		{
+			name:     "not regexp",
+			matchers: []*labels.Matcher{labels.MustNewMatcher(labels.MatchNotRegexp, "cluster", "eu1|us1")},
+			expected: ULIDs(2),
+		},
+		{
+			name: "all matchers have to match",
+			matchers: []*labels.Matcher{
+				labels.MustNewMatcher(labels.MatchRegexp, "cluster", "eu.*|us.*"),
+				labels.MustNewMatcher(labels.MatchEqual, "tenant", "a"),
+				labels.MustNewMatcher(labels.MatchNotEqual, "cluster", "eu2"),
+			},
+			expected: ULIDs(1),
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			input := newInput()
+			m := newTestFetcherMetrics()
+			testutil.Ok(t, NewLabelMatchMetaFilter(tcase.matchers).Filter(ctx, input, m.Synced))
+			compareSliceWithMapKeys(t, input, tcase.expected)
+			testutil.Equals(t, float64(4-len(tcase.expected)), promtest.ToFloat64(m.Synced.WithLabelValues(labelMismatchMeta)))
+		})
+	}
+}
+
+func TestMaxAgeMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	now := time.Unix(1000*24*60*60, 0)
+	boundary := timestamp.FromTime(now.Add(-400 * 24 * time.Hour))
+	newInput := func() map[ulid.ULID]*metadata.Meta {
+		return map[ulid.ULID]*metadata.Meta{
+			ULID(1): {BlockMeta: tsdb.BlockMeta{MinTime: boundary - 2000, MaxTime: boundary - 1}},
+			ULID(2): {BlockMeta: tsdb.BlockMeta{MinTime: boundary - 2000, MaxTime: boundary}},
+			ULID(3): {BlockMeta: tsdb.BlockMeta{MinTime: boundary - 1000, MaxTime: boundary + 1}},
+			ULID(4): {BlockMeta: tsdb.BlockMeta{MinTime: boundary, MaxTime: timestamp.FromTime(now)}},
+		}
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		input := newInput()
+		m := newTestFetcherMetrics()
+		f := NewMaxAgeMetaFilter(0)
+		f.now = func() time.Time { return now }
+		testutil.Ok(t, f.Filter(ctx, input, m.Synced))
+		compareSliceWithMapKeys(t, input, ULIDs(1, 2, 3, 4))
+		testutil.Equals(t, 0.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooOldMeta)))
+	})
+	t.Run("enabled", func(t *testing.T) {
+		input := newInput()
+		m := newTestFetcherMetrics()
+		f := NewMaxAgeMetaFilter(400 * 24 * time.Hour)
+		f.now = func() time.Time { return now }
+		testutil.Ok(t, f.Filter(ctx, input, m.Synced))
+		compareSliceWithMapKeys(t, input, ULIDs(2, 3, 4))
+		testutil.Equals(t, 1.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooOldMeta)))
+
+		// Blocks age with the clock.
+		input = newInput()
+		m = newTestFetcherMetrics()
+		f.now = func() time.Time { return now.Add(2 * time.Millisecond) }
+		testutil.Ok(t, f.Filter(ctx, input, m.Synced))
+		compareSliceWithMapKeys(t, input, ULIDs(4))
+		testutil.Equals(t, 3.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooOldMeta)))
+	})
+}
+
 func TestLabelShardedMetaFilter_Filter_Hashmod(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
@@ -875,6 +2630,59 @@ func TestDeduplicateFilter_Filter(t *testing.T) {
 	}
 }
 
+func TestOverlapDetector_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	meta := func(id int, mint, maxt int64, res int64, lset map[string]string) *metadata.Meta {
+		return &metadata.Meta{
+			BlockMeta: tsdb.BlockMeta{ULID: ULID(id), MinTime: mint, MaxTime: maxt},
+			Thanos: metadata.Thanos{
+				Labels:     lset,
+				Downsample: metadata.ThanosDownsample{Resolution: res},
+			},
+		}
+	}
+	a, b := map[string]string{"cluster": "a"}, map[string]string{"cluster": "b"}
+
+	metas := map[ulid.ULID]*metadata.Meta{
+		// Group a: 1 and 2 are adjacent, 3 overlaps with 2, 4 overlaps with 2 and 3.
+		ULID(1): meta(1, 0, 100, 0, a),
+		ULID(2): meta(2, 100, 200, 0, a),
+		ULID(3): meta(3, 150, 250, 0, a),
+		ULID(4): meta(4, 190, 210, 0, a),
+		// Downsampled blocks overlap with raw ones by design.
+		ULID(5): meta(5, 0, 300, 300000, a),
+		// Group b does not overlap.
+		ULID(6): meta(6, 0, 100, 0, b),
+		ULID(7): meta(7, 100, 200, 0, b),
+	}
+	expected := map[ulid.ULID]*metadata.Meta{}
+	for id, m := range metas {
+		expected[id] = m
+	}
+
+	reg := prometheus.NewRegistry()
+	f := NewOverlapDetector(nil, reg)
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, metas, m.Synced))
+
+	// Diagnostic only, nothing is filtered out.
+	testutil.Equals(t, expected, metas)
+	testutil.Equals(t, []Overlap{
+		{Group: `{cluster="a"}@0`, First: ULID(2), Second: ULID(3)},
+		{Group: `{cluster="a"}@0`, First: ULID(2), Second: ULID(4)},
+		{Group: `{cluster="a"}@0`, First: ULID(3), Second: ULID(4)},
+	}, f.Overlaps())
+	testutil.Equals(t, 1.0, promtest.ToFloat64(f.overlappingGroups))
+
+	delete(metas, ULID(3))
+	delete(metas, ULID(4))
+	testutil.Ok(t, f.Filter(ctx, metas, m.Synced))
+	testutil.Equals(t, 0, len(f.Overlaps()))
+	testutil.Equals(t, 0.0, promtest.ToFloat64(f.overlappingGroups))
+}
+
 func TestReplicaLabelRemover_Modify(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
@@ -884,6 +2692,7 @@ func TestReplicaLabelRemover_Modify(t *testing.T) {
 		input               map[ulid.ULID]*metadata.Meta
 		expected            map[ulid.ULID]*metadata.Meta
 		modified            float64
+		modifiedIDs         []ulid.ULID
 		replicaLabelRemover *ReplicaLabelRemover
 	}{
 		{
@@ -916,6 +2725,7 @@ func TestReplicaLabelRemover_Modify(t *testing.T) {
 				ULID(4): {Thanos: metadata.Thanos{Labels: map[string]string{"replica": "deduped"}}},
 			},
 			modified:            5.0,
+			modifiedIDs:         []ulid.ULID{ULID(2), ULID(3), ULID(4)},
 			replicaLabelRemover: NewReplicaLabelRemover(log.NewNopLogger(), []string{"replica", "rule_replica"}),
 		},
 		{
@@ -938,7 +2748,12 @@ func TestReplicaLabelRemover_Modify(t *testing.T) {
 		testutil.Ok(t, tcase.replicaLabelRemover.Modify(ctx, tcase.input, m.Modified))
 
 		testutil.Equals(t, tcase.modified, promtest.ToFloat64(m.Modified.WithLabelValues(replicaRemovedMeta)))
+		testutil.Equals(t, tcase.modifiedIDs, tcase.replicaLabelRemover.ModifiedIDs())
 		testutil.Equals(t, tcase.expected, tcase.input)
+
+		// Modified IDs are reset on every run.
+		testutil.Ok(t, tcase.replicaLabelRemover.Modify(ctx, map[ulid.ULID]*metadata.Meta{}, m.Modified))
+		testutil.Equals(t, 0, len(tcase.replicaLabelRemover.ModifiedIDs()))
 	}
 }
 
@@ -1065,6 +2880,7 @@ func TestConsistencyDelayMetaFilter_Filter_0(t *testing.T) {
 		reg := prometheus.NewRegistry()
 		f := NewConsistencyDelayMetaFilter(nil, 30*time.Minute, reg)
 		testutil.Equals(t, map[string]float64{"consistency_delay_seconds{}": (30 * time.Minute).Seconds()}, extprom.CurrentGaugeValuesFor(t, reg, "consistency_delay_seconds"))
+		testutil.Equals(t, 30*time.Minute, f.Delay())
 
 		testutil.Ok(t, f.Filter(ctx, input, m.Synced))
 		testutil.Equals(t, float64(len(u.created)-len(expected)), promtest.ToFloat64(m.Synced.WithLabelValues(tooFreshMeta)))
@@ -1072,6 +2888,130 @@ func TestConsistencyDelayMetaFilter_Filter_0(t *testing.T) {
 	})
 }
 
+func TestConsistencyDelayMetaFilter_Filter_SourceDelays(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	// Sidecar needs 1h, compactor blocks are delayed as well, other sources use the default 30m.
+	f := NewConsistencyDelayMetaFilter(nil, 30*time.Minute, nil,
+		WithSourceConsistencyDelay(metadata.SidecarSource, time.Hour),
+		WithSourceConsistencyDelay(metadata.CompactorSource, 10*time.Minute),
+	)
+	testutil.Equals(t, 30*time.Minute, f.Delay())
+	delays := map[metadata.SourceType]time.Duration{
+		metadata.SidecarSource:   time.Hour,
+		metadata.ReceiveSource:   30 * time.Minute,
+		metadata.CompactorSource: 10 * time.Minute,
+	}
+
+	var (
+		u        = &ulidBuilder{}
+		now      = time.Now()
+		input    = map[ulid.ULID]*metadata.Meta{}
+		expected = map[ulid.ULID]*metadata.Meta{}
+	)
+	for _, age := range []time.Duration{time.Minute, 29 * time.Minute, 59 * time.Minute, 2 * time.Hour} {
+		for source, delay := range delays {
+			id := u.ULID(now.Add(-age))
+			input[id] = &metadata.Meta{Thanos: metadata.Thanos{Source: source}}
+			if age >= delay {
+				expected[id] = input[id]
+			}
+		}
+	}
+
+	m := newTestFetcherMetrics()
+	testutil.Ok(t, f.Filter(ctx, input, m.Synced))
+	testutil.Equals(t, 6.0, promtest.ToFloat64(m.Synced.WithLabelValues(tooFreshMeta)))
+	testutil.Equals(t, expected, input)
+}
+
+func TestPredicateMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	withSize := func(sizes ...int64) *metadata.Meta {
+		m := &metadata.Meta{}
+		for i, s := range sizes {
+			m.Thanos.Files = append(m.Thanos.Files, metadata.File{RelPath: fmt.Sprintf("chunks/%06d", i+1), SizeBytes: s})
+		}
+		return m
+	}
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): withSize(100),
+		ULID(2): withSize(600, 600),
+		ULID(3): withSize(),
+		ULID(4): withSize(1000, 1),
+	}
+
+	f := NewPredicateMetaFilter("too-small", func(m *metadata.Meta) bool {
+		var size int64
+		for _, file := range m.Thanos.Files {
+			size += file.SizeBytes
+		}
+		return size > 1000
+	})
+
+	m := NewFetcherMetrics(nil, [][]string{{"too-small"}}, nil)
+	testutil.Ok(t, f.Filter(ctx, input, m.Synced))
+	compareSliceWithMapKeys(t, input, ULIDs(2, 4))
+	testutil.Equals(t, 2.0, promtest.ToFloat64(m.Synced.WithLabelValues("too-small")))
+
+	// MetaFetcher initializes the state of the filter in the synced metric.
+	reg := prometheus.NewRegistry()
+	baseFetcher, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(objstore.NewInMemBucket()), "", nil)
+	testutil.Ok(t, err)
+	_, _, err = baseFetcher.NewMetaFetcher(reg, []MetadataFilter{f}, nil).Fetch(ctx)
+	testutil.Ok(t, err)
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	found := false
+	for _, mf := range mfs {
+		if mf.GetName() != "blocks_meta_synced" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "state" && l.GetValue() == "too-small" {
+					found = true
+				}
+			}
+		}
+	}
+	testutil.Assert(t, found, "expected too-small state in the synced metric")
+}
+
+func TestMaxBlocksMetaFilter_Filter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	input := map[ulid.ULID]*metadata.Meta{
+		ULID(1): {BlockMeta: tsdb.BlockMeta{MinTime: 100, MaxTime: 200}},
+		ULID(2): {BlockMeta: tsdb.BlockMeta{MinTime: 500, MaxTime: 600}},
+		ULID(3): {BlockMeta: tsdb.BlockMeta{MinTime: 0, MaxTime: 100}},
+		ULID(4): {BlockMeta: tsdb.BlockMeta{MinTime: 300, MaxTime: 400}},
+		ULID(5): {BlockMeta: tsdb.BlockMeta{MinTime: 200, MaxTime: 300}},
+	}
+
+	t.Run("under limit", func(t *testing.T) {
+		metas := map[ulid.ULID]*metadata.Meta{}
+		for id, m := range input {
+			metas[id] = m
+		}
+
+		m := newTestFetcherMetrics()
+		testutil.Ok(t, NewMaxBlocksMetaFilter(nil, 5).Filter(ctx, metas, m.Synced))
+		testutil.Equals(t, input, metas)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(m.Synced.WithLabelValues(blockLimitExceededMeta)))
+	})
+	t.Run("over limit", func(t *testing.T) {
+		m := newTestFetcherMetrics()
+		testutil.Ok(t, NewMaxBlocksMetaFilter(nil, 3).Filter(ctx, input, m.Synced))
+		compareSliceWithMapKeys(t, input, ULIDs(2, 4, 5))
+		testutil.Equals(t, 2.0, promtest.ToFloat64(m.Synced.WithLabelValues(blockLimitExceededMeta)))
+	})
+}
+
 func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 	objtesting.ForeachStore(t, func(t *testing.T, bkt objstore.Bucket) {
 		ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
@@ -1121,6 +3061,157 @@ func TestIgnoreDeletionMarkFilter_Filter(t *testing.T) {
 	})
 }
 
+// iterRecordingBucket records directories listed by Iter.
+type iterRecordingBucket struct {
+	objstore.Bucket
+
+	mtx  sync.Mutex
+	dirs []string
+}
+
+func (b *iterRecordingBucket) Iter(ctx context.Context, dir string, f func(string) error, options ...objstore.IterOption) error {
+	b.mtx.Lock()
+	b.dirs = append(b.dirs, dir)
+	b.mtx.Unlock()
+	return b.Bucket.Iter(ctx, dir, f, options...)
+}
+
+func TestIgnoreDeletionMarkFilter_StaleMarks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	bkt := objstore.NewInMemBucket()
+	uploadMark := func(id ulid.ULID) {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.DeletionMark{ID: id, DeletionTime: time.Now().Unix(), Version: 1}))
+		testutil.Ok(t, bkt.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), &buf))
+	}
+	// Block 1 is marked and passed to the filter, block 2 is marked, but excluded by a previous filter.
+	for _, id := range ULIDs(1, 2) {
+		uploadTestMeta(t, ctx, bkt, metadata.Meta{BlockMeta: tsdb.BlockMeta{Version: 1, ULID: id}})
+		uploadMark(id)
+	}
+	// Block 3 is partially deleted, block 4 only has deletion mark left.
+	testutil.Ok(t, bkt.Upload(ctx, path.Join(ULID(3).String(), "index"), bytes.NewBufferString("index")))
+	uploadMark(ULID(3))
+	uploadMark(ULID(4))
+
+	baseFetcher, err := NewBaseFetcher(log.NewNopLogger(), 1, objstore.WithNoopInstr(bkt), "", nil)
+	testutil.Ok(t, err)
+	without2 := ULID(2)
+	fetch := func(f *IgnoreDeletionMarkFilter) {
+		_, _, err := baseFetcher.NewMetaFetcher(nil, []MetadataFilter{&ulidFilter{ulidToDelete: &without2}, f}, nil).Fetch(ctx)
+		testutil.Ok(t, err)
+	}
+
+	f := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 48*time.Hour, 32)
+	fetch(f)
+	testutil.Equals(t, 0, len(f.StaleMarks()))
+
+	// Only directories of blocks without meta.json are listed.
+	rbkt := &iterRecordingBucket{Bucket: bkt}
+	f = NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(rbkt), 48*time.Hour, 32, WithStaleMarksDetection(nil, 0))
+	fetch(f)
+	testutil.Equals(t, ULIDs(4), f.StaleMarks())
+	testutil.Equals(t, 1, len(f.DeletionMarkBlocks()))
+	sort.Strings(rbkt.dirs)
+	testutil.Equals(t, []string{ULID(3).String(), ULID(4).String()}, rbkt.dirs)
+
+	f = NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 48*time.Hour, 32, WithStaleMarksDetection(bkt, 0))
+	fetch(f)
+	testutil.Equals(t, ULIDs(4), f.StaleMarks())
+	ok, err := bkt.Exists(ctx, path.Join(ULID(4).String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, !ok, "expected stale deletion mark to be deleted")
+	ok, err = bkt.Exists(ctx, path.Join(ULID(3).String(), metadata.DeletionMarkFilename))
+	testutil.Ok(t, err)
+	testutil.Assert(t, ok, "expected deletion mark of partially deleted block to be kept")
+
+	fetch(f)
+	testutil.Equals(t, 0, len(f.StaleMarks()))
+
+	// Detection with interval doesn't run again until the interval passes.
+	limited := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 48*time.Hour, 32, WithStaleMarksDetection(nil, time.Hour))
+	fetch(limited)
+	testutil.Equals(t, 0, len(limited.StaleMarks()))
+
+	uploadMark(ULID(5))
+	fetch(limited)
+	testutil.Equals(t, 0, len(limited.StaleMarks()))
+	f = NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 48*time.Hour, 32, WithStaleMarksDetection(nil, 0))
+	fetch(f)
+	testutil.Equals(t, ULIDs(5), f.StaleMarks())
+}
+
+// failingGetBucket fails the first Get calls of objects as configured by failures and counts Get calls per object.
+type failingGetBucket struct {
+	objstore.Bucket
+
+	mtx      sync.Mutex
+	failures map[string]int
+	gets     map[string]int
+}
+
+func (b *failingGetBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	b.gets[name]++
+	fail := b.gets[name] <= b.failures[name]
+	b.mtx.Unlock()
+	if fail {
+		return nil, errors.New("transient failure")
+	}
+	return b.Bucket.Get(ctx, name)
+}
+
+func TestIgnoreDeletionMarkFilter_ReadRetries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+
+	inmem := objstore.NewInMemBucket()
+	uploadMark := func(id ulid.ULID, version int) {
+		var buf bytes.Buffer
+		testutil.Ok(t, json.NewEncoder(&buf).Encode(&metadata.DeletionMark{ID: id, DeletionTime: time.Now().Add(-time.Hour).Unix(), Version: version}))
+		testutil.Ok(t, inmem.Upload(ctx, path.Join(id.String(), metadata.DeletionMarkFilename), &buf))
+	}
+	uploadMark(ULID(1), metadata.DeletionMarkVersion1)
+	// Block 3 has deletion mark of unsupported version.
+	uploadMark(ULID(3), 2)
+
+	mark := func(id ulid.ULID) string { return path.Join(id.String(), metadata.DeletionMarkFilename) }
+	newBucket := func(failures int) *failingGetBucket {
+		return &failingGetBucket{Bucket: inmem, failures: map[string]int{mark(ULID(1)): failures}, gets: map[string]int{}}
+	}
+
+	t.Run("no retries", func(t *testing.T) {
+		bkt := newBucket(1)
+		f := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 0, 1)
+		testutil.NotOk(t, f.Filter(ctx, map[ulid.ULID]*metadata.Meta{ULID(1): {}}, newTestFetcherMetrics().Synced))
+		testutil.Equals(t, 1, bkt.gets[mark(ULID(1))])
+	})
+	t.Run("transient failure is retried", func(t *testing.T) {
+		bkt := newBucket(1)
+		f := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 0, 1, WithDeletionMarkReadRetries(2, time.Millisecond))
+		metas := map[ulid.ULID]*metadata.Meta{ULID(1): {}, ULID(2): {}}
+		testutil.Ok(t, f.Filter(ctx, metas, newTestFetcherMetrics().Synced))
+		compareSliceWithMapKeys(t, metas, ULIDs(2))
+		testutil.Equals(t, 2, bkt.gets[mark(ULID(1))])
+		// Missing deletion mark is not retried.
+		testutil.Equals(t, 1, bkt.gets[mark(ULID(2))])
+	})
+	t.Run("retries exhausted", func(t *testing.T) {
+		bkt := newBucket(3)
+		f := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 0, 1, WithDeletionMarkReadRetries(2, time.Millisecond))
+		testutil.NotOk(t, f.Filter(ctx, map[ulid.ULID]*metadata.Meta{ULID(1): {}}, newTestFetcherMetrics().Synced))
+		testutil.Equals(t, 3, bkt.gets[mark(ULID(1))])
+	})
+	t.Run("invalid deletion mark is not retried", func(t *testing.T) {
+		bkt := newBucket(0)
+		f := NewIgnoreDeletionMarkFilter(log.NewNopLogger(), objstore.WithNoopInstr(bkt), 0, 1, WithDeletionMarkReadRetries(2, time.Millisecond))
+		testutil.NotOk(t, f.Filter(ctx, map[ulid.ULID]*metadata.Meta{ULID(3): {}}, newTestFetcherMetrics().Synced))
+		testutil.Equals(t, 1, bkt.gets[mark(ULID(3))])
+	})
+}
+
 func BenchmarkDeduplicateFilter_Filter(b *testing.B) {
 
 	var (
@@ -18,6 +18,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/tsdb"
@@ -76,6 +77,10 @@ type Thanos struct {
 	// Source is a real upload source of the block.
 	Source SourceType `json:"source"`
 
+	// ProducerVersion is the version of Thanos that produced the block. Optional, absent in blocks produced by older
+	// versions or by builds without version information.
+	ProducerVersion string `json:"producer_version,omitempty"`
+
 	// List of segment files (in chunks directory), in sorted order. Optional.
 	// Deprecated. Use Files instead.
 	SegmentFiles []string `json:"segment_files,omitempty"`
@@ -125,7 +130,8 @@ type ThanosDownsample struct {
 	Resolution int64 `json:"resolution"`
 }
 
-// InjectThanos sets Thanos meta to the block meta JSON and saves it to the disk.
+// InjectThanos sets Thanos meta to the block meta JSON and saves it to the disk. Unless given, producer version is set
+// to the current version.
 // NOTE: It should be used after writing any block by any Thanos component, otherwise we will miss crucial metadata.
 func InjectThanos(logger log.Logger, bdir string, meta Thanos, downsampledMeta *tsdb.BlockMeta) (*Meta, error) {
 	newMeta, err := ReadFromDir(bdir)
@@ -133,6 +139,9 @@ func InjectThanos(logger log.Logger, bdir string, meta Thanos, downsampledMeta *
 		return nil, errors.Wrap(err, "read new meta")
 	}
 	newMeta.Thanos = meta
+	if newMeta.Thanos.ProducerVersion == "" {
+		newMeta.Thanos.ProducerVersion = version.Version
+	}
 
 	// While downsampling we need to copy original compaction.
 	if downsampledMeta != nil {
@@ -13,6 +13,7 @@ import (
 	"github.com/go-kit/kit/log"
 	"github.com/oklog/ulid"
 	"github.com/pkg/errors"
+	"github.com/prometheus/common/version"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/pkg/value"
 	"github.com/prometheus/prometheus/tsdb"
@@ -80,9 +81,10 @@ func Downsample(
 		}
 	}()
 
-	// Copy original meta to the new one. Update downsampling resolution and ULID for a new block.
+	// Copy original meta to the new one. Update downsampling resolution, producer version and ULID for a new block.
 	newMeta := *origMeta
 	newMeta.Thanos.Downsample.Resolution = resolution
+	newMeta.Thanos.ProducerVersion = version.Version
 	newMeta.ULID = uid
 
 	// Writes downsampled chunks right into the files, avoiding excess memory allocation.
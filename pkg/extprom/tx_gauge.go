@@ -8,12 +8,14 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type TxGaugeVec struct {
 	current      *prometheus.GaugeVec
 	mtx          sync.Mutex
 	newMetricVal func() *prometheus.GaugeVec
+	labelNames   []string
 
 	tx *prometheus.GaugeVec
 }
@@ -37,6 +39,7 @@ func NewTxGaugeVec(reg prometheus.Registerer, opts prometheus.GaugeOpts, labelNa
 	tx := &TxGaugeVec{
 		current:      f(),
 		newMetricVal: f,
+		labelNames:   labelNames,
 	}
 	if reg != nil {
 		reg.MustRegister(tx)
@@ -60,6 +63,51 @@ func (tx *TxGaugeVec) Submit() {
 	tx.mtx.Unlock()
 }
 
+// Value returns the value of the gauge with given label values, as last submitted and exposed to Prometheus, or 0 if
+// there is no such gauge. Values set within the current transaction are not visible until Submit. Useful in tests.
+func (tx *TxGaugeVec) Value(lvs ...string) float64 {
+	tx.mtx.Lock()
+	current := tx.current
+	tx.mtx.Unlock()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		current.Collect(ch)
+		close(ch)
+	}()
+
+	var val float64
+	for m := range ch {
+		var d dto.Metric
+		if err := m.Write(&d); err != nil {
+			continue
+		}
+		if tx.matches(d.GetLabel(), lvs) {
+			val = d.GetGauge().GetValue()
+		}
+	}
+	return val
+}
+
+func (tx *TxGaugeVec) matches(lps []*dto.LabelPair, lvs []string) bool {
+	if len(lps) != len(lvs) {
+		return false
+	}
+	for i, name := range tx.labelNames {
+		matched := false
+		for _, lp := range lps {
+			if lp.GetName() == name {
+				matched = lp.GetValue() == lvs[i]
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
 // Describe is used in Register.
 func (tx *TxGaugeVec) Describe(ch chan<- *prometheus.Desc) {
 	tx.mtx.Lock()
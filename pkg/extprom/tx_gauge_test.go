@@ -180,3 +180,27 @@ func lbToString(pairs []*dto.LabelPair) string {
 	}
 	return strings.Join(ret, ",")
 }
+
+func TestTxGaugeVec_Value(t *testing.T) {
+	g := NewTxGaugeVec(nil, prometheus.GaugeOpts{
+		Name: "metric",
+	}, []string{"a", "b"}, []string{"a1", "b1"})
+
+	g.ResetTx()
+	g.WithLabelValues("a1", "b1").Set(2)
+	g.WithLabelValues("a2", "b2").Set(3)
+	// Not submitted yet.
+	testutil.Equals(t, 0.0, g.Value("a1", "b1"))
+	testutil.Equals(t, 0.0, g.Value("a2", "b2"))
+
+	g.Submit()
+	testutil.Equals(t, 2.0, g.Value("a1", "b1"))
+	testutil.Equals(t, 3.0, g.Value("a2", "b2"))
+	testutil.Equals(t, 0.0, g.Value("b1", "a1"))
+	testutil.Equals(t, 0.0, g.Value("a1"))
+
+	g.ResetTx()
+	g.Submit()
+	testutil.Equals(t, 0.0, g.Value("a1", "b1"))
+	testutil.Equals(t, 0.0, g.Value("a2", "b2"))
+}
@@ -0,0 +1,187 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ObjectAccess is the number of read accesses to the object with the given name.
+type ObjectAccess struct {
+	Name  string
+	Count int64
+}
+
+// AccessStatsBucket is a Bucket that records how often objects are read (Get, GetRange, Exists and Attributes), to spot hotspots
+// and inform caching decisions. Memory is bounded: only a limited number of names is tracked using the space-saving algorithm,
+// so counts of rarely accessed names are approximate, while the most accessed names are reliably kept.
+type AccessStatsBucket struct {
+	Bucket
+
+	k      int
+	window time.Duration
+	now    func() time.Time
+
+	mtx         sync.Mutex
+	windowStart time.Time
+	current     *accessCounter
+	previous    *accessCounter
+}
+
+// BucketWithAccessStats returns a bucket that tracks top k most read objects of b, over the sliding window of given duration.
+func BucketWithAccessStats(b Bucket, k int, window time.Duration) *AccessStatsBucket {
+	s := &AccessStatsBucket{
+		Bucket: b,
+		k:      k,
+		window: window,
+		now:    time.Now,
+	}
+	s.windowStart = s.now()
+	s.current = newAccessCounter(s.capacity())
+	s.previous = newAccessCounter(s.capacity())
+	return s
+}
+
+// capacity returns the number of tracked names. Tracking more than k names makes top k more accurate.
+func (b *AccessStatsBucket) capacity() int {
+	return 10 * b.k
+}
+
+func (b *AccessStatsBucket) record(name string) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if now := b.now(); now.Sub(b.windowStart) >= b.window {
+		b.previous = b.current
+		if now.Sub(b.windowStart) >= 2*b.window {
+			// No accesses in the whole previous window.
+			b.previous = newAccessCounter(b.capacity())
+		}
+		b.current = newAccessCounter(b.capacity())
+		b.windowStart = now
+	}
+	b.current.inc(name)
+}
+
+// TopK returns up to k most read objects within the current and previous window, the most read first.
+func (b *AccessStatsBucket) TopK() []ObjectAccess {
+	b.mtx.Lock()
+	counts := make(map[string]int64, len(b.current.counts)+len(b.previous.counts))
+	for n, e := range b.previous.counts {
+		counts[n] += e.count
+	}
+	for n, e := range b.current.counts {
+		counts[n] += e.count
+	}
+	b.mtx.Unlock()
+
+	top := make([]ObjectAccess, 0, len(counts))
+	for n, c := range counts {
+		top = append(top, ObjectAccess{Name: n, Count: c})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count == top[j].Count {
+			return top[i].Name < top[j].Name
+		}
+		return top[i].Count > top[j].Count
+	})
+	if len(top) > b.k {
+		top = top[:b.k]
+	}
+	return top
+}
+
+func (b *AccessStatsBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.record(name)
+	return b.Bucket.Get(ctx, name)
+}
+
+func (b *AccessStatsBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	b.record(name)
+	return b.Bucket.GetRange(ctx, name, off, length)
+}
+
+func (b *AccessStatsBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.record(name)
+	return b.Bucket.Exists(ctx, name)
+}
+
+func (b *AccessStatsBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	b.record(name)
+	return b.Bucket.Attributes(ctx, name)
+}
+
+// accessCounter counts accesses of at most capacity names. When full, the least accessed name is replaced by the new one,
+// which inherits its count (space-saving algorithm), so counts are overestimated rather than names of hot objects lost.
+// Entries are kept in a min-heap by count, so the least accessed name is found in O(1) and updated in O(log capacity).
+type accessCounter struct {
+	capacity int
+	counts   map[string]*accessEntry
+	heap     accessHeap
+}
+
+type accessEntry struct {
+	name  string
+	count int64
+	index int
+}
+
+func newAccessCounter(capacity int) *accessCounter {
+	return &accessCounter{capacity: capacity, counts: make(map[string]*accessEntry, capacity)}
+}
+
+func (c *accessCounter) inc(name string) {
+	if c.capacity <= 0 {
+		return
+	}
+	if e, ok := c.counts[name]; ok {
+		e.count++
+		heap.Fix(&c.heap, e.index)
+		return
+	}
+	if len(c.counts) < c.capacity {
+		e := &accessEntry{name: name, count: 1}
+		c.counts[name] = e
+		heap.Push(&c.heap, e)
+		return
+	}
+
+	// Replace the least accessed name.
+	e := c.heap[0]
+	delete(c.counts, e.name)
+	e.name = name
+	e.count++
+	c.counts[name] = e
+	heap.Fix(&c.heap, e.index)
+}
+
+// accessHeap is a min-heap of access entries by count.
+type accessHeap []*accessEntry
+
+func (h accessHeap) Len() int           { return len(h) }
+func (h accessHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h accessHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *accessHeap) Push(x interface{}) {
+	e := x.(*accessEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *accessHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
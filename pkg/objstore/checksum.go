@@ -0,0 +1,121 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+
+	"github.com/thanos-io/thanos/pkg/runutil"
+)
+
+// ChecksumSuffix is the suffix of the sidecar object holding the hex encoded SHA-256 checksum of the object it's
+// appended to, e.g. "<block>/meta.json.sha256" for "<block>/meta.json". Output of sha256sum is accepted too.
+const ChecksumSuffix = ".sha256"
+
+// ErrChecksumMismatch is returned when reading an object which content doesn't match its stored checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// BucketWithChecksumVerification returns a bucket that verifies content returned by Get against the checksum stored in
+// the sidecar object (see ChecksumSuffix), for objects which name matches any of the given patterns (see path.Match).
+// Content is verified while it's read: the reader returns an error wrapping ErrChecksumMismatch instead of io.EOF
+// if the content doesn't match. Content is verified only when it's read until io.EOF, readers closed earlier are not
+// verified. Objects without a sidecar object and ranges returned by GetRange are not verified.
+func BucketWithChecksumVerification(b Bucket, logger log.Logger, patterns ...string) (Bucket, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", p)
+		}
+	}
+	return &checksumBucket{Bucket: b, logger: logger, patterns: patterns}, nil
+}
+
+type checksumBucket struct {
+	Bucket
+
+	logger   log.Logger
+	patterns []string
+}
+
+func (b *checksumBucket) verified(name string) bool {
+	for _, p := range b.patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *checksumBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if !b.verified(name) {
+		return b.Bucket.Get(ctx, name)
+	}
+
+	expected, err := b.checksum(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil || expected == nil {
+		return rc, err
+	}
+	return &checksumReader{ReadCloser: rc, name: name, h: sha256.New(), expected: expected}, nil
+}
+
+// checksum returns the stored checksum of the given object, or nil if there is none.
+func (b *checksumBucket) checksum(ctx context.Context, name string) ([]byte, error) {
+	rc, err := b.Bucket.Get(ctx, name+ChecksumSuffix)
+	if err != nil {
+		if b.Bucket.IsObjNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "get checksum of %s", name)
+	}
+	defer runutil.CloseWithLogOnErr(b.logger, rc, "close checksum reader of %s", name)
+
+	c, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read checksum of %s", name)
+	}
+	fields := strings.Fields(string(c))
+	if len(fields) == 0 {
+		return nil, errors.Errorf("empty checksum of %s", name)
+	}
+	expected, err := hex.DecodeString(fields[0])
+	if err != nil || len(expected) != sha256.Size {
+		return nil, errors.Errorf("invalid SHA-256 checksum of %s: %q", name, fields[0])
+	}
+	return expected, nil
+}
+
+// checksumReader hashes the content while it's read and compares it with the expected checksum at io.EOF. Closing the
+// reader before io.EOF skips the verification, as the rest of the content is never read.
+type checksumReader struct {
+	io.ReadCloser
+
+	name     string
+	h        hash.Hash
+	expected []byte
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	_, _ = r.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := r.h.Sum(nil); !bytes.Equal(actual, r.expected) {
+			return n, errors.Wrapf(ErrChecksumMismatch, "object %s: expected %x, got %x", r.name, r.expected, actual)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,32 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package filesystem
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/thanos-io/thanos/pkg/testutil"
+)
+
+func TestBucket_Attributes_NoVersion(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "filesystem-attributes-test")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	bkt, err := NewBucket(dir)
+	testutil.Ok(t, err)
+	testutil.Ok(t, bkt.Upload(ctx, "obj", strings.NewReader("data")))
+
+	attrs, err := bkt.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, int64(4), attrs.Size)
+	// Filesystem does not support versioning.
+	testutil.Equals(t, "", attrs.Version)
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +25,8 @@ type InMemBucket struct {
 	mtx     sync.RWMutex
 	objects map[string][]byte
 	attrs   map[string]ObjectAttributes
+	// versions is incremented on every upload, so rewritten objects get a new version.
+	versions int64
 }
 
 // NewInMemBucket returns a new in memory Bucket.
@@ -176,9 +179,11 @@ func (b *InMemBucket) Upload(_ context.Context, name string, r io.Reader) error
 		return err
 	}
 	b.objects[name] = body
+	b.versions++
 	b.attrs[name] = ObjectAttributes{
 		Size:         int64(len(body)),
 		LastModified: time.Now(),
+		Version:      strconv.FormatInt(b.versions, 10),
 	}
 	return nil
 }
@@ -0,0 +1,186 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/semaphore"
+)
+
+// BucketWithConcurrencyLimit returns a bucket that allows at most maxInFlight operations against b at the same time,
+// no matter how many callers share it. Operations over the cap block until a slot frees up or their context is done.
+// Readers returned by Get and GetRange hold their slot until they are closed. Iter holds its slot while listing, but not
+// while the iteration function runs, so the function can use the same limited bucket. Zero or negative maxInFlight
+// means no limit, and b is returned as it is. Many limited buckets can share the same registry, including ones with
+// the same bucket name, which are accounted together.
+func BucketWithConcurrencyLimit(b Bucket, maxInFlight int, reg prometheus.Registerer) Bucket {
+	if maxInFlight <= 0 {
+		return b
+	}
+	return &limitedBucket{
+		bkt:      b,
+		sem:      semaphore.NewWeighted(int64(maxInFlight)),
+		inFlight: inFlightGaugeVec(reg).WithLabelValues(b.Name()),
+	}
+}
+
+// inFlightGaugeVec returns the in-flight operations metric registered in reg, registering it on the first call.
+func inFlightGaugeVec(reg prometheus.Registerer) *prometheus.GaugeVec {
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "thanos_objstore_bucket_operations_in_flight",
+		Help: "Number of operations against a bucket currently holding a concurrency limit slot.",
+	}, []string{"bucket"})
+	if reg == nil {
+		return g
+	}
+	if err := reg.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			if existing, ok := are.ExistingCollector.(*prometheus.GaugeVec); ok {
+				return existing
+			}
+		}
+		panic(err)
+	}
+	return g
+}
+
+type limitedBucket struct {
+	bkt      Bucket
+	sem      *semaphore.Weighted
+	inFlight prometheus.Gauge
+}
+
+func (b *limitedBucket) acquire(ctx context.Context) error {
+	if err := b.sem.Acquire(ctx, 1); err != nil {
+		return err
+	}
+	b.inFlight.Inc()
+	return nil
+}
+
+func (b *limitedBucket) release() {
+	b.inFlight.Dec()
+	b.sem.Release(1)
+}
+
+func (b *limitedBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	held := true
+	defer func() {
+		if held {
+			b.release()
+		}
+	}()
+
+	return b.bkt.Iter(ctx, dir, func(name string) error {
+		// Don't hold the slot while the caller processes the name, as it might wait on other operations against b.
+		b.release()
+		held = false
+		if err := f(name); err != nil {
+			return err
+		}
+		if err := b.acquire(ctx); err != nil {
+			return err
+		}
+		held = true
+		return nil
+	}, options...)
+}
+
+func (b *limitedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &limitedReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	if err := b.acquire(ctx); err != nil {
+		return nil, err
+	}
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	return &limitedReadCloser{ReadCloser: rc, release: b.release}, nil
+}
+
+func (b *limitedBucket) Exists(ctx context.Context, name string) (bool, error) {
+	if err := b.acquire(ctx); err != nil {
+		return false, err
+	}
+	defer b.release()
+
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *limitedBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	if err := b.acquire(ctx); err != nil {
+		return ObjectAttributes{}, err
+	}
+	defer b.release()
+
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *limitedBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *limitedBucket) Delete(ctx context.Context, name string) error {
+	if err := b.acquire(ctx); err != nil {
+		return err
+	}
+	defer b.release()
+
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *limitedBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *limitedBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *limitedBucket) Name() string {
+	return b.bkt.Name()
+}
+
+// limitedReadCloser releases its concurrency limit slot once, on the first Close. It forwards the size of the wrapped
+// reader (see ObjectSizer).
+type limitedReadCloser struct {
+	io.ReadCloser
+
+	once    sync.Once
+	release func()
+}
+
+func (rc *limitedReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+func (rc *limitedReadCloser) ObjectSize() (int64, error) {
+	return TryToGetSize(rc.ReadCloser)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UploadedPart identifies the part of a multipart upload.
+type UploadedPart struct {
+	// Number of the part, starting from 1.
+	Number int
+	// ETag is the backend specific identifier of the uploaded part content.
+	ETag string
+}
+
+// multipartAbortTimeout bounds aborting of the failed multipart upload, which runs even if the upload context is done.
+const multipartAbortTimeout = 30 * time.Second
+
+// MultipartUploader is an optional capability of a Bucket to upload an object in multiple parts. It's implemented by
+// the S3 bucket.
+type MultipartUploader interface {
+	// InitiateMultipartUpload starts the multipart upload of the object with the given name and returns its ID.
+	InitiateMultipartUpload(ctx context.Context, name string) (uploadID string, err error)
+
+	// UploadPart uploads size bytes read from r as the part with the given number.
+	UploadPart(ctx context.Context, name, uploadID string, number int, r io.Reader, size int64) (UploadedPart, error)
+
+	// CompleteMultipartUpload assembles the object from the given parts, in order.
+	CompleteMultipartUpload(ctx context.Context, name, uploadID string, parts []UploadedPart) error
+
+	// AbortMultipartUpload discards the multipart upload and its already uploaded parts.
+	AbortMultipartUpload(ctx context.Context, name, uploadID string) error
+}
+
+// BucketWithMultipartUploads returns a bucket that uploads objects larger than threshold bytes in parts of partSize
+// bytes, if b implements MultipartUploader. Uploads of smaller objects, or of readers which size is not known upfront
+// (see TryToGetSize), are passed to b as they are.
+func BucketWithMultipartUploads(b Bucket, threshold, partSize int64) Bucket {
+	return &multipartBucket{Bucket: b, threshold: threshold, partSize: partSize}
+}
+
+type multipartBucket struct {
+	Bucket
+
+	threshold int64
+	partSize  int64
+}
+
+func (b *multipartBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	mu, ok := b.Bucket.(MultipartUploader)
+	if !ok || b.partSize <= 0 {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+	size, err := TryToGetSize(r)
+	if err != nil || size <= b.threshold {
+		return b.Bucket.Upload(ctx, name, r)
+	}
+
+	uploadID, err := mu.InitiateMultipartUpload(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "initiate multipart upload of %s", name)
+	}
+
+	parts := make([]UploadedPart, 0, (size+b.partSize-1)/b.partSize)
+	for off, number := int64(0), 1; off < size; off, number = off+b.partSize, number+1 {
+		partSize := b.partSize
+		if size-off < partSize {
+			partSize = size - off
+		}
+		part, err := mu.UploadPart(ctx, name, uploadID, number, io.LimitReader(r, partSize), partSize)
+		if err != nil {
+			return abortMultipartUpload(ctx, mu, name, uploadID, errors.Wrapf(err, "upload part %d of %s", number, name))
+		}
+		parts = append(parts, part)
+	}
+
+	if err := mu.CompleteMultipartUpload(ctx, name, uploadID, parts); err != nil {
+		return abortMultipartUpload(ctx, mu, name, uploadID, errors.Wrapf(err, "complete multipart upload of %s", name))
+	}
+	return nil
+}
+
+// abortMultipartUpload aborts the failed multipart upload, so already uploaded parts are not left behind, and returns
+// the given cause. The upload often fails because ctx is done, so the abort doesn't use its cancellation.
+func abortMultipartUpload(ctx context.Context, mu MultipartUploader, name, uploadID string, cause error) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), multipartAbortTimeout)
+	defer cancel()
+
+	if err := mu.AbortMultipartUpload(ctx, name, uploadID); err != nil {
+		return errors.Wrapf(cause, "abort multipart upload failed: %v", err)
+	}
+	return cause
+}
@@ -6,10 +6,13 @@ package objstore
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -18,6 +21,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/thanos-io/thanos/pkg/errutil"
 	"github.com/thanos-io/thanos/pkg/runutil"
 )
 
@@ -123,12 +127,24 @@ type ObjectAttributes struct {
 
 	// LastModified is the timestamp the object was last modified.
 	LastModified time.Time `json:"last_modified"`
+
+	// Version is the object version or generation ID, if the bucket supports versioning. Otherwise it's empty.
+	// A different version of the object with the same name means the object was rewritten.
+	Version string `json:"version,omitempty"`
+}
+
+// ObjectSizer is implemented by readers which know the size of the object upfront, e.g. wrappers of other readers.
+type ObjectSizer interface {
+	// ObjectSize returns the size of the object in bytes, or error if it's not known.
+	ObjectSize() (int64, error)
 }
 
 // TryToGetSize tries to get upfront size from reader.
 // TODO(https://github.com/thanos-io/thanos/issues/678): Remove guessing length when minio provider will support multipart upload without this.
 func TryToGetSize(r io.Reader) (int64, error) {
 	switch f := r.(type) {
+	case ObjectSizer:
+		return f.ObjectSize()
 	case *os.File:
 		fileInfo, err := f.Stat()
 		if err != nil {
@@ -166,6 +182,71 @@ func UploadDir(ctx context.Context, logger log.Logger, bkt Bucket, srcdir, dstdi
 	})
 }
 
+// UploadDirConcurrently uploads all files in srcdir to the bucket into a top-level directory named dstdir, using up to
+// concurrency parallel uploads. Unlike UploadDir, it does not stop on the first failed upload; all failures are returned
+// as errutil.MultiError. It is a caller responsibility to clean partial upload in case of failure.
+func UploadDirConcurrently(ctx context.Context, logger log.Logger, bkt Bucket, srcdir, dstdir string, concurrency int) error {
+	df, err := os.Stat(srcdir)
+	if err != nil {
+		return errors.Wrap(err, "stat dir")
+	}
+	if !df.IsDir() {
+		return errors.Errorf("%s is not a directory", srcdir)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var srcs []string
+	if err := filepath.Walk(srcdir, func(src string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			srcs = append(srcs, src)
+		}
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "walk dir")
+	}
+
+	var (
+		wg   sync.WaitGroup
+		ch   = make(chan string)
+		mtx  sync.Mutex
+		errs errutil.MultiError
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for src := range ch {
+				if err := UploadFile(ctx, logger, bkt, src, filepath.Join(dstdir, strings.TrimPrefix(src, srcdir))); err != nil {
+					mtx.Lock()
+					errs.Add(err)
+					mtx.Unlock()
+				}
+			}
+		}()
+	}
+
+Outer:
+	for _, src := range srcs {
+		select {
+		case <-ctx.Done():
+			mtx.Lock()
+			errs.Add(ctx.Err())
+			mtx.Unlock()
+			break Outer
+		case ch <- src:
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return errs.Err()
+}
+
 // UploadFile uploads the file with the given name to the bucket.
 // It is a caller responsibility to clean partial upload in case of failure.
 func UploadFile(ctx context.Context, logger log.Logger, bkt Bucket, src, dst string) error {
@@ -258,6 +339,34 @@ func DownloadDir(ctx context.Context, logger log.Logger, bkt BucketReader, origi
 	return nil
 }
 
+// GlobalConfigFilename is the conventional name of the bucket-level global config object, stored in the bucket root.
+const GlobalConfigFilename = "thanos-config.json"
+
+// ErrGlobalConfigNotFound is returned by ReadGlobalConfig when the config object doesn't exist.
+var ErrGlobalConfigNotFound = errors.New("global config not found")
+
+// ReadGlobalConfig reads the JSON config object with the given name (e.g. GlobalConfigFilename) from the bucket and
+// unmarshals it into out. It returns error which cause is ErrGlobalConfigNotFound if the object doesn't exist.
+func ReadGlobalConfig(ctx context.Context, bkt BucketReader, name string, out interface{}) (err error) {
+	rc, err := bkt.Get(ctx, name)
+	if err != nil {
+		if bkt.IsObjNotFoundErr(err) {
+			return errors.Wrapf(ErrGlobalConfigNotFound, "get %s", name)
+		}
+		return errors.Wrapf(err, "get %s", name)
+	}
+	defer runutil.CloseWithErrCapture(&err, rc, "close global config reader")
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return errors.Wrapf(err, "read %s", name)
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return errors.Wrapf(err, "unmarshal %s", name)
+	}
+	return nil
+}
+
 // IsOpFailureExpectedFunc allows to mark certain errors as expected, so they will not increment thanos_objstore_bucket_operation_failures_total metric.
 type IsOpFailureExpectedFunc func(error) bool
 
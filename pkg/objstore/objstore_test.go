@@ -4,10 +4,26 @@
 package objstore
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	promtest "github.com/prometheus/client_golang/prometheus/testutil"
 
+	"github.com/thanos-io/thanos/pkg/errutil"
 	"github.com/thanos-io/thanos/pkg/testutil"
 )
 
@@ -63,3 +79,586 @@ func TestMetricBucket_Close(t *testing.T) {
 	testutil.Equals(t, 7, promtest.CollectAndCount(bkt.opsDuration))
 	testutil.Assert(t, promtest.ToFloat64(bkt.lastSuccessfulUploadTime) > lastUpload)
 }
+
+func TestInMemBucket_AttributesVersion(t *testing.T) {
+	ctx := context.Background()
+	bkt := NewInMemBucket()
+
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("v1"))))
+	attrs, err := bkt.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, attrs.Version != "", "expected version to be set")
+
+	// Same name and size, but rewritten in place.
+	testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("v2"))))
+	rewritten, err := bkt.Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, attrs.Size, rewritten.Size)
+	testutil.Assert(t, attrs.Version != rewritten.Version, "expected new version after rewrite, got %s", rewritten.Version)
+
+	// Version is forwarded by wrappers.
+	wrapped, err := BucketWithMetrics("abc", bkt, nil).Attributes(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, rewritten.Version, wrapped.Version)
+}
+
+// concurrencyTrackingBucket records the maximum number of concurrent Exists calls.
+type concurrencyTrackingBucket struct {
+	Bucket
+
+	mtx      sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (b *concurrencyTrackingBucket) Exists(ctx context.Context, name string) (bool, error) {
+	b.mtx.Lock()
+	b.inFlight++
+	if b.inFlight > b.max {
+		b.max = b.inFlight
+	}
+	b.mtx.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	b.mtx.Lock()
+	b.inFlight--
+	b.mtx.Unlock()
+	return b.Bucket.Exists(ctx, name)
+}
+
+func TestBucketWithConcurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("acceptance", func(t *testing.T) {
+		// Acceptance test keeps a few readers open at once and deletes objects while iterating.
+		AcceptanceTest(t, BucketWithConcurrencyLimit(NewInMemBucket(), 10, nil))
+	})
+
+	t.Run("cap is never exceeded", func(t *testing.T) {
+		inner := &concurrencyTrackingBucket{Bucket: NewInMemBucket()}
+		bkt := BucketWithConcurrencyLimit(inner, 3, nil)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := bkt.Exists(ctx, "obj")
+				testutil.Ok(t, err)
+			}()
+		}
+		wg.Wait()
+
+		testutil.Equals(t, 3, inner.max)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.(*limitedBucket).inFlight))
+	})
+
+	t.Run("reader holds slot until closed", func(t *testing.T) {
+		bkt := BucketWithConcurrencyLimit(NewInMemBucket(), 1, nil)
+		testutil.Ok(t, bkt.Upload(ctx, "obj", bytes.NewReader([]byte("data"))))
+
+		rc, err := bkt.Get(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1.0, promtest.ToFloat64(bkt.(*limitedBucket).inFlight))
+
+		// The only slot is taken, so the next operation has to wait until the context is done.
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = bkt.Exists(timeoutCtx, "obj")
+		testutil.Equals(t, context.DeadlineExceeded, errors.Cause(err))
+
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "data", string(b))
+		testutil.Ok(t, rc.Close())
+		// Closing twice must not release the slot twice.
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.(*limitedBucket).inFlight))
+
+		ok, err := bkt.Exists(ctx, "obj")
+		testutil.Ok(t, err)
+		testutil.Assert(t, ok)
+	})
+
+	t.Run("iteration function doesn't hold slot", func(t *testing.T) {
+		bkt := BucketWithConcurrencyLimit(NewInMemBucket(), 1, nil)
+		for _, name := range []string{"a/obj", "b/obj", "c/obj"} {
+			testutil.Ok(t, bkt.Upload(ctx, name, strings.NewReader("data")))
+		}
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		// Each name is processed by another goroutine using the only slot, like BaseFetcher workers do.
+		var seen []string
+		testutil.Ok(t, bkt.Iter(timeoutCtx, "", func(name string) error {
+			errc := make(chan error)
+			go func() {
+				_, err := bkt.Exists(timeoutCtx, name+"obj")
+				errc <- err
+			}()
+			seen = append(seen, name)
+			return <-errc
+		}))
+		testutil.Equals(t, []string{"a/", "b/", "c/"}, seen)
+		testutil.Equals(t, 0.0, promtest.ToFloat64(bkt.(*limitedBucket).inFlight))
+	})
+
+	t.Run("no limit", func(t *testing.T) {
+		inner := NewInMemBucket()
+		testutil.Equals(t, Bucket(inner), BucketWithConcurrencyLimit(inner, 0, nil))
+		testutil.Equals(t, Bucket(inner), BucketWithConcurrencyLimit(inner, -1, nil))
+	})
+
+	t.Run("buckets share registry", func(t *testing.T) {
+		reg := prometheus.NewRegistry()
+		inner := NewInMemBucket()
+		testutil.Ok(t, inner.Upload(ctx, "a", strings.NewReader("a")))
+		first := BucketWithConcurrencyLimit(inner, 1, reg)
+		second := BucketWithConcurrencyLimit(inner, 1, reg)
+
+		rc, err := first.Get(ctx, "a")
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1.0, promtest.ToFloat64(second.(*limitedBucket).inFlight))
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, 0.0, promtest.ToFloat64(second.(*limitedBucket).inFlight))
+	})
+
+	t.Run("reader size is forwarded", func(t *testing.T) {
+		bkt := BucketWithConcurrencyLimit(sizedBucket{Bucket: NewInMemBucket()}, 1, nil)
+		testutil.Ok(t, bkt.Upload(ctx, "a", strings.NewReader("abc")))
+
+		rc, err := bkt.Get(ctx, "a")
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		size, err := TryToGetSize(rc)
+		testutil.Ok(t, err)
+		testutil.Equals(t, int64(3), size)
+	})
+}
+
+// sizedBucket returns readers which know the size of the object.
+type sizedBucket struct {
+	Bucket
+}
+
+func (b sizedBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	attrs, err := b.Bucket.Attributes(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.Bucket.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return sizedReadCloser{ReadCloser: rc, size: attrs.Size}, nil
+}
+
+type sizedReadCloser struct {
+	io.ReadCloser
+
+	size int64
+}
+
+func (rc sizedReadCloser) ObjectSize() (int64, error) { return rc.size, nil }
+
+func TestBucketWithSlowLog(t *testing.T) {
+	ctx := context.Background()
+
+	buf := &bytes.Buffer{}
+	logger := log.NewLogfmtLogger(log.NewSyncWriter(buf))
+
+	// Exists of concurrencyTrackingBucket takes at least 5ms.
+	inner := &concurrencyTrackingBucket{Bucket: NewInMemBucket()}
+	testutil.Ok(t, inner.Upload(ctx, "obj", strings.NewReader("data")))
+
+	bkt := BucketWithSlowLog(inner, logger, time.Millisecond)
+	_, err := bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Assert(t, strings.Contains(buf.String(), `msg="slow bucket operation" operation=exists name=obj`), "expected slow log line, got %q", buf.String())
+	testutil.Assert(t, strings.Contains(buf.String(), "suppressed=0"), "expected no suppressed lines, got %q", buf.String())
+
+	// Next slow operation shortly after is not logged.
+	buf.Reset()
+	_, err = bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "", buf.String())
+
+	// Fast operations are never logged.
+	bkt = BucketWithSlowLog(inner, logger, time.Hour)
+	_, err = bkt.Exists(ctx, "obj")
+	testutil.Ok(t, err)
+	rc, err := bkt.Get(ctx, "obj")
+	testutil.Ok(t, err)
+	testutil.Ok(t, rc.Close())
+	testutil.Equals(t, "", buf.String())
+}
+
+func TestBucketWithAccessStats(t *testing.T) {
+	ctx := context.Background()
+
+	inner := NewInMemBucket()
+	for _, name := range []string{"a/meta.json", "a/deletion-mark.json", "b/meta.json"} {
+		testutil.Ok(t, inner.Upload(ctx, name, strings.NewReader("{}")))
+	}
+
+	now := time.Unix(0, 0)
+	bkt := BucketWithAccessStats(inner, 2, time.Minute)
+	bkt.now = func() time.Time { return now }
+	bkt.windowStart = now
+
+	for i := 0; i < 50; i++ {
+		_, err := bkt.Exists(ctx, "a/meta.json")
+		testutil.Ok(t, err)
+	}
+	for i := 0; i < 30; i++ {
+		rc, err := bkt.Get(ctx, "a/deletion-mark.json")
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+	}
+	_, err := bkt.Attributes(ctx, "b/meta.json")
+	testutil.Ok(t, err)
+	// Many rarely accessed names must not evict hot ones. Only names accessed more often than total accesses divided by
+	// the number of tracked names are guaranteed to stay.
+	for i := 0; i < 100; i++ {
+		_, err := bkt.Exists(ctx, fmt.Sprintf("cold-%d", i))
+		testutil.Ok(t, err)
+	}
+	// Writes are not counted.
+	for i := 0; i < 20; i++ {
+		testutil.Ok(t, bkt.Upload(ctx, "b/meta.json", strings.NewReader("{}")))
+	}
+
+	expected := []ObjectAccess{{Name: "a/meta.json", Count: 50}, {Name: "a/deletion-mark.json", Count: 30}}
+	testutil.Equals(t, expected, bkt.TopK())
+	testutil.Equals(t, 2*10, len(bkt.current.counts))
+
+	// Accesses from the previous window are still taken into account.
+	now = now.Add(time.Minute)
+	_, err = bkt.Exists(ctx, "a/deletion-mark.json")
+	testutil.Ok(t, err)
+	expected[1].Count++
+	testutil.Equals(t, expected, bkt.TopK())
+
+	// After two windows older accesses are forgotten.
+	now = now.Add(2 * time.Minute)
+	_, err = bkt.Exists(ctx, "b/meta.json")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []ObjectAccess{{Name: "b/meta.json", Count: 1}}, bkt.TopK())
+}
+
+func TestAccessCounter(t *testing.T) {
+	c := newAccessCounter(2)
+	for _, name := range []string{"a", "a", "a", "b", "b", "c", "c", "c", "c"} {
+		c.inc(name)
+	}
+	counts := map[string]int64{}
+	for n, e := range c.counts {
+		counts[n] = e.count
+	}
+	// "c" replaced "b" and inherited its count.
+	testutil.Equals(t, map[string]int64{"a": 3, "c": 6}, counts)
+	testutil.Equals(t, "a", c.heap[0].name)
+}
+
+// uploadTrackingBucket records the maximum number of concurrent uploads and fails uploads of objects with "fail" in name.
+type uploadTrackingBucket struct {
+	Bucket
+
+	mtx      sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (b *uploadTrackingBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	b.mtx.Lock()
+	b.inFlight++
+	if b.inFlight > b.max {
+		b.max = b.inFlight
+	}
+	b.mtx.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	b.mtx.Lock()
+	b.inFlight--
+	b.mtx.Unlock()
+
+	if strings.Contains(name, "fail") {
+		return errors.New("upload failed")
+	}
+	return b.Bucket.Upload(ctx, name, r)
+}
+
+func TestUploadDirConcurrently(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "test-upload-dir-concurrently")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	testutil.Ok(t, os.MkdirAll(filepath.Join(dir, "chunks"), os.ModePerm))
+	files := []string{"meta.json", "index", "fail1", filepath.Join("chunks", "000001"), filepath.Join("chunks", "000002"), filepath.Join("chunks", "fail2")}
+	for _, f := range files {
+		testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, f), []byte(f), os.ModePerm))
+	}
+
+	inner := &uploadTrackingBucket{Bucket: NewInMemBucket()}
+	err = UploadDirConcurrently(ctx, log.NewNopLogger(), inner, dir, "block", 3)
+	testutil.NotOk(t, err)
+
+	// All files are attempted, failures are collected.
+	merr, ok := err.(errutil.NonNilMultiError)
+	testutil.Assert(t, ok, "expected multi error, got %T", err)
+	testutil.Equals(t, 2, len(merr))
+	testutil.Assert(t, inner.max > 1 && inner.max <= 3, "expected concurrent uploads up to 3, got %d", inner.max)
+
+	for _, f := range []string{"meta.json", "index", "chunks/000001", "chunks/000002"} {
+		rc, err := inner.Get(ctx, "block/"+f)
+		testutil.Ok(t, err)
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		testutil.Ok(t, rc.Close())
+		testutil.Equals(t, filepath.FromSlash(f), string(b))
+	}
+
+	testutil.NotOk(t, UploadDirConcurrently(ctx, log.NewNopLogger(), inner, filepath.Join(dir, "meta.json"), "block", 3))
+}
+
+// multipartInMemBucket is an in-memory bucket that supports multipart uploads.
+type multipartInMemBucket struct {
+	*InMemBucket
+
+	mtx          sync.Mutex
+	uploads      map[string][][]byte
+	partSizes    []int64
+	aborted      int
+	failPart     int
+	failComplete bool
+}
+
+func (b *multipartInMemBucket) InitiateMultipartUpload(_ context.Context, name string) (string, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	id := fmt.Sprintf("%s-%d", name, len(b.uploads))
+	b.uploads[id] = nil
+	return id, nil
+}
+
+func (b *multipartInMemBucket) UploadPart(ctx context.Context, _, uploadID string, number int, r io.Reader, size int64) (UploadedPart, error) {
+	if err := ctx.Err(); err != nil {
+		return UploadedPart{}, err
+	}
+	if number == b.failPart {
+		return UploadedPart{}, errors.New("part upload failed")
+	}
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return UploadedPart{}, err
+	}
+	if int64(len(p)) != size {
+		return UploadedPart{}, errors.Errorf("expected %d bytes, got %d", size, len(p))
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.uploads[uploadID] = append(b.uploads[uploadID], p)
+	b.partSizes = append(b.partSizes, size)
+	return UploadedPart{Number: number, ETag: fmt.Sprintf("%d", number)}, nil
+}
+
+func (b *multipartInMemBucket) CompleteMultipartUpload(ctx context.Context, name, uploadID string, parts []UploadedPart) error {
+	if b.failComplete {
+		return errors.New("complete failed")
+	}
+
+	b.mtx.Lock()
+	data := b.uploads[uploadID]
+	delete(b.uploads, uploadID)
+	b.mtx.Unlock()
+
+	if len(parts) != len(data) {
+		return errors.Errorf("expected %d parts, got %d", len(data), len(parts))
+	}
+	return b.InMemBucket.Upload(ctx, name, bytes.NewReader(bytes.Join(data, nil)))
+}
+
+func (b *multipartInMemBucket) AbortMultipartUpload(ctx context.Context, _, uploadID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	delete(b.uploads, uploadID)
+	b.aborted++
+	return nil
+}
+
+func TestBucketWithMultipartUploads(t *testing.T) {
+	ctx := context.Background()
+
+	content := func(t *testing.T, bkt Bucket, name string) string {
+		rc, err := bkt.Get(ctx, name)
+		testutil.Ok(t, err)
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		b, err := ioutil.ReadAll(rc)
+		testutil.Ok(t, err)
+		return string(b)
+	}
+
+	t.Run("large object is uploaded in parts", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		testutil.Ok(t, bkt.Upload(ctx, "large", strings.NewReader("0123456789")))
+		testutil.Equals(t, []int64{4, 4, 2}, inner.partSizes)
+		testutil.Equals(t, "0123456789", content(t, bkt, "large"))
+	})
+	t.Run("small object is uploaded at once", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		testutil.Ok(t, bkt.Upload(ctx, "small", strings.NewReader("01234")))
+		testutil.Equals(t, 0, len(inner.partSizes))
+		testutil.Equals(t, "01234", content(t, bkt, "small"))
+	})
+	t.Run("reader of unknown size is uploaded at once", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		testutil.Ok(t, bkt.Upload(ctx, "unknown", io.MultiReader(strings.NewReader("0123456789"))))
+		testutil.Equals(t, 0, len(inner.partSizes))
+		testutil.Equals(t, "0123456789", content(t, bkt, "unknown"))
+	})
+	t.Run("failed part aborts upload", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}, failPart: 2}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		testutil.NotOk(t, bkt.Upload(ctx, "large", strings.NewReader("0123456789")))
+		testutil.Equals(t, 1, inner.aborted)
+		testutil.Equals(t, 0, len(inner.uploads))
+		ok, err := bkt.Exists(ctx, "large")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "expected no object after aborted upload")
+	})
+	t.Run("failed complete aborts upload", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}, failComplete: true}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		testutil.NotOk(t, bkt.Upload(ctx, "large", strings.NewReader("0123456789")))
+		testutil.Equals(t, []int64{4, 4, 2}, inner.partSizes)
+		testutil.Equals(t, 1, inner.aborted)
+		testutil.Equals(t, 0, len(inner.uploads))
+		ok, err := bkt.Exists(ctx, "large")
+		testutil.Ok(t, err)
+		testutil.Assert(t, !ok, "expected no object after aborted upload")
+	})
+	t.Run("canceled upload is aborted", func(t *testing.T) {
+		inner := &multipartInMemBucket{InMemBucket: NewInMemBucket(), uploads: map[string][][]byte{}}
+		bkt := BucketWithMultipartUploads(inner, 5, 4)
+
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		err := bkt.Upload(cctx, "large", strings.NewReader("0123456789"))
+		testutil.NotOk(t, err)
+		testutil.Equals(t, context.Canceled, errors.Cause(err))
+		testutil.Equals(t, 1, inner.aborted)
+		testutil.Equals(t, 0, len(inner.uploads))
+	})
+	t.Run("bucket without multipart support", func(t *testing.T) {
+		bkt := BucketWithMultipartUploads(NewInMemBucket(), 5, 4)
+
+		testutil.Ok(t, bkt.Upload(ctx, "large", strings.NewReader("0123456789")))
+		testutil.Equals(t, "0123456789", content(t, bkt, "large"))
+	})
+}
+
+func TestBucketWithChecksumVerification(t *testing.T) {
+	ctx := context.Background()
+
+	_, err := BucketWithChecksumVerification(NewInMemBucket(), log.NewNopLogger(), "[")
+	testutil.NotOk(t, err)
+
+	inner := NewInMemBucket()
+	content := `{"ulid": "01EZ", "version": 1}`
+	sum := sha256.Sum256([]byte(content))
+	testutil.Ok(t, inner.Upload(ctx, "a/meta.json", strings.NewReader(content)))
+	testutil.Ok(t, inner.Upload(ctx, "a/meta.json"+ChecksumSuffix, strings.NewReader(hex.EncodeToString(sum[:])+"  meta.json\n")))
+	testutil.Ok(t, inner.Upload(ctx, "b/meta.json", strings.NewReader(`{"ulid": "01EZ", "version": 2}`)))
+	testutil.Ok(t, inner.Upload(ctx, "b/meta.json"+ChecksumSuffix, strings.NewReader(hex.EncodeToString(sum[:]))))
+	testutil.Ok(t, inner.Upload(ctx, "b/index", strings.NewReader("index")))
+	testutil.Ok(t, inner.Upload(ctx, "b/index"+ChecksumSuffix, strings.NewReader(hex.EncodeToString(sum[:]))))
+	testutil.Ok(t, inner.Upload(ctx, "c/meta.json", strings.NewReader(content)))
+
+	bkt, err := BucketWithChecksumVerification(inner, log.NewNopLogger(), "*/meta.json")
+	testutil.Ok(t, err)
+
+	read := func(name string) (string, error) {
+		rc, err := bkt.Get(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		defer func() { testutil.Ok(t, rc.Close()) }()
+		b, err := ioutil.ReadAll(rc)
+		return string(b), err
+	}
+
+	got, err := read("a/meta.json")
+	testutil.Ok(t, err)
+	testutil.Equals(t, content, got)
+
+	// Corrupted payload.
+	_, err = read("b/meta.json")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, ErrChecksumMismatch, errors.Cause(err))
+
+	// Objects not matching any pattern are not verified.
+	got, err = read("b/index")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "index", got)
+
+	// Objects without checksum are not verified.
+	got, err = read("c/meta.json")
+	testutil.Ok(t, err)
+	testutil.Equals(t, content, got)
+
+	_, err = read("d/meta.json")
+	testutil.NotOk(t, err)
+	testutil.Assert(t, bkt.IsObjNotFoundErr(err), "expected not found error, got %v", err)
+}
+
+func TestReadGlobalConfig(t *testing.T) {
+	ctx := context.Background()
+
+	type tenantConfig struct {
+		Tenants map[string]struct {
+			Retention string `json:"retention"`
+		} `json:"tenants"`
+	}
+
+	bkt := NewInMemBucket()
+	testutil.Ok(t, bkt.Upload(ctx, GlobalConfigFilename, strings.NewReader(`{"tenants": {"team-a": {"retention": "30d"}}}`)))
+	testutil.Ok(t, bkt.Upload(ctx, "malformed.json", strings.NewReader(`{"tenants": `)))
+
+	t.Run("present", func(t *testing.T) {
+		var cfg tenantConfig
+		testutil.Ok(t, ReadGlobalConfig(ctx, bkt, GlobalConfigFilename, &cfg))
+		testutil.Equals(t, 1, len(cfg.Tenants))
+		testutil.Equals(t, "30d", cfg.Tenants["team-a"].Retention)
+	})
+	t.Run("absent", func(t *testing.T) {
+		var cfg tenantConfig
+		err := ReadGlobalConfig(ctx, bkt, "absent.json", &cfg)
+		testutil.NotOk(t, err)
+		testutil.Equals(t, ErrGlobalConfigNotFound, errors.Cause(err))
+	})
+	t.Run("malformed", func(t *testing.T) {
+		var cfg tenantConfig
+		err := ReadGlobalConfig(ctx, bkt, "malformed.json", &cfg)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, errors.Cause(err) != ErrGlobalConfigNotFound, "expected unmarshal error, got %v", err)
+	})
+}
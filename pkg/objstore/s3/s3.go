@@ -472,6 +472,65 @@ func (b *Bucket) Upload(ctx context.Context, name string, r io.Reader) error {
 	return nil
 }
 
+var _ objstore.MultipartUploader = &Bucket{}
+
+// InitiateMultipartUpload starts the multipart upload of the object with the given name.
+func (b *Bucket) InitiateMultipartUpload(ctx context.Context, name string) (string, error) {
+	sse, err := b.getServerSideEncryption(ctx)
+	if err != nil {
+		return "", err
+	}
+	core := minio.Core{Client: b.client}
+	uploadID, err := core.NewMultipartUpload(ctx, b.name, name, minio.PutObjectOptions{
+		ServerSideEncryption: sse,
+		UserMetadata:         b.putUserMetadata,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "initiate s3 multipart upload")
+	}
+	return uploadID, nil
+}
+
+// UploadPart uploads size bytes read from r as the part with the given number.
+func (b *Bucket) UploadPart(ctx context.Context, name, uploadID string, number int, r io.Reader, size int64) (objstore.UploadedPart, error) {
+	sse, err := b.getServerSideEncryption(ctx)
+	if err != nil {
+		return objstore.UploadedPart{}, err
+	}
+	// Only customer provided keys have to be sent with every part.
+	if sse != nil && sse.Type() != encrypt.SSEC {
+		sse = nil
+	}
+	core := minio.Core{Client: b.client}
+	part, err := core.PutObjectPart(ctx, b.name, name, uploadID, number, r, size, "", "", sse)
+	if err != nil {
+		return objstore.UploadedPart{}, errors.Wrap(err, "upload s3 object part")
+	}
+	return objstore.UploadedPart{Number: part.PartNumber, ETag: part.ETag}, nil
+}
+
+// CompleteMultipartUpload assembles the object from the given parts, in order.
+func (b *Bucket) CompleteMultipartUpload(ctx context.Context, name, uploadID string, parts []objstore.UploadedPart) error {
+	completeParts := make([]minio.CompletePart, 0, len(parts))
+	for _, p := range parts {
+		completeParts = append(completeParts, minio.CompletePart{PartNumber: p.Number, ETag: p.ETag})
+	}
+	core := minio.Core{Client: b.client}
+	if _, err := core.CompleteMultipartUpload(ctx, b.name, name, uploadID, completeParts); err != nil {
+		return errors.Wrap(err, "complete s3 multipart upload")
+	}
+	return nil
+}
+
+// AbortMultipartUpload discards the multipart upload and its already uploaded parts.
+func (b *Bucket) AbortMultipartUpload(ctx context.Context, name, uploadID string) error {
+	core := minio.Core{Client: b.client}
+	if err := core.AbortMultipartUpload(ctx, b.name, name, uploadID); err != nil {
+		return errors.Wrap(err, "abort s3 multipart upload")
+	}
+	return nil
+}
+
 // Attributes returns information about the specified object.
 func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAttributes, error) {
 	objInfo, err := b.client.StatObject(ctx, b.name, name, minio.StatObjectOptions{})
@@ -482,6 +541,7 @@ func (b *Bucket) Attributes(ctx context.Context, name string) (objstore.ObjectAt
 	return objstore.ObjectAttributes{
 		Size:         objInfo.Size,
 		LastModified: objInfo.LastModified,
+		Version:      objInfo.VersionID,
 	}, nil
 }
 
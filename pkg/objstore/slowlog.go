@@ -0,0 +1,125 @@
+// Copyright (c) The Thanos Authors.
+// Licensed under the Apache License 2.0.
+
+package objstore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// slowLogInterval is the minimum interval between two slow operation log lines, to avoid floods when the whole backend is slow.
+const slowLogInterval = time.Second
+
+// BucketWithSlowLog returns a bucket that logs operations against b which took longer than threshold, together with the
+// object name and duration. Get and GetRange are timed until the returned reader is closed. Log lines are rate limited;
+// the number of slow operations not logged since the previous line is reported as "suppressed".
+func BucketWithSlowLog(b Bucket, logger log.Logger, threshold time.Duration) Bucket {
+	return &slowLogBucket{bkt: b, logger: logger, threshold: threshold}
+}
+
+type slowLogBucket struct {
+	bkt       Bucket
+	logger    log.Logger
+	threshold time.Duration
+
+	mtx        sync.Mutex
+	lastLogged time.Time
+	suppressed int
+}
+
+func (b *slowLogBucket) observe(op, name string, start time.Time) {
+	duration := time.Since(start)
+	if duration < b.threshold {
+		return
+	}
+
+	b.mtx.Lock()
+	if time.Since(b.lastLogged) < slowLogInterval {
+		b.suppressed++
+		b.mtx.Unlock()
+		return
+	}
+	suppressed := b.suppressed
+	b.lastLogged = time.Now()
+	b.suppressed = 0
+	b.mtx.Unlock()
+
+	level.Warn(b.logger).Log("msg", "slow bucket operation", "operation", op, "name", name, "duration", duration, "threshold", b.threshold, "suppressed", suppressed)
+}
+
+func (b *slowLogBucket) Iter(ctx context.Context, dir string, f func(name string) error, options ...IterOption) error {
+	defer b.observe(OpIter, dir, time.Now())
+	return b.bkt.Iter(ctx, dir, f, options...)
+}
+
+func (b *slowLogBucket) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := b.bkt.Get(ctx, name)
+	if err != nil {
+		b.observe(OpGet, name, start)
+		return nil, err
+	}
+	return &slowLogReadCloser{ReadCloser: rc, done: func() { b.observe(OpGet, name, start) }}, nil
+}
+
+func (b *slowLogBucket) GetRange(ctx context.Context, name string, off, length int64) (io.ReadCloser, error) {
+	start := time.Now()
+	rc, err := b.bkt.GetRange(ctx, name, off, length)
+	if err != nil {
+		b.observe(OpGetRange, name, start)
+		return nil, err
+	}
+	return &slowLogReadCloser{ReadCloser: rc, done: func() { b.observe(OpGetRange, name, start) }}, nil
+}
+
+func (b *slowLogBucket) Exists(ctx context.Context, name string) (bool, error) {
+	defer b.observe(OpExists, name, time.Now())
+	return b.bkt.Exists(ctx, name)
+}
+
+func (b *slowLogBucket) Attributes(ctx context.Context, name string) (ObjectAttributes, error) {
+	defer b.observe(OpAttributes, name, time.Now())
+	return b.bkt.Attributes(ctx, name)
+}
+
+func (b *slowLogBucket) Upload(ctx context.Context, name string, r io.Reader) error {
+	defer b.observe(OpUpload, name, time.Now())
+	return b.bkt.Upload(ctx, name, r)
+}
+
+func (b *slowLogBucket) Delete(ctx context.Context, name string) error {
+	defer b.observe(OpDelete, name, time.Now())
+	return b.bkt.Delete(ctx, name)
+}
+
+func (b *slowLogBucket) IsObjNotFoundErr(err error) bool {
+	return b.bkt.IsObjNotFoundErr(err)
+}
+
+func (b *slowLogBucket) Close() error {
+	return b.bkt.Close()
+}
+
+func (b *slowLogBucket) Name() string {
+	return b.bkt.Name()
+}
+
+// slowLogReadCloser observes the operation once, on the first Close.
+type slowLogReadCloser struct {
+	io.ReadCloser
+
+	once sync.Once
+	done func()
+}
+
+func (rc *slowLogReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.done)
+	return err
+}
@@ -38,6 +38,20 @@ func tracerFromContext(ctx context.Context) opentracing.Tracer {
 	return nil
 }
 
+// GetTraceIDFromContext returns the trace ID of the span within given context, if any. It requires the opentracing.Tracer
+// propagated in context to implement Tracer.
+func GetTraceIDFromContext(ctx context.Context) (string, bool) {
+	t, ok := tracerFromContext(ctx).(Tracer)
+	if !ok {
+		return "", false
+	}
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return "", false
+	}
+	return t.GetTraceIDFromSpanContext(span.Context())
+}
+
 // CopyTraceContext copies the necessary trace context from given source context to target context.
 func CopyTraceContext(trgt, src context.Context) context.Context {
 	ctx := ContextWithTracer(trgt, tracerFromContext(src))